@@ -0,0 +1,531 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+var errArtifactNotFound = errors.New("artifact not found")
+
+// artifactStore is a place to sync runs to. Files are stored once per content
+// under objects/, every run has an index mapping its paths to them:
+//
+//	<target>/
+//	  objects/sha256/<ab>/<hash>
+//	  <project>/<experiment>/<run>/index.json
+type artifactStore interface {
+	exists(key string) (bool, error)
+	// get fails with errArtifactNotFound for missing keys.
+	get(key string) (io.ReadCloser, error)
+	// put stores size bytes of r, sum is their hex sha256.
+	put(key string, r io.ReadSeeker, size int64, sum string) error
+	String() string
+}
+
+// ArtifactsSpec configures where runs are synced to, in invoker.json or on
+// the command line.
+type ArtifactsSpec struct {
+	// Target is s3://bucket/prefix, file:///path or a plain path.
+	Target string `json:"target,omitempty"`
+	// Endpoint is the url of an S3 compatible service, e.g. MinIO. Empty
+	// means AWS.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// openArtifactStore opens the store of spec, uploadsPath keeps track of
+// unfinished uploads to it.
+func openArtifactStore(spec ArtifactsSpec, uploadsPath string) (artifactStore, error) {
+	if spec.Target == "" {
+		return nil, errors.New("no artifact target, set --target or artifacts.target in invoker.json")
+	}
+
+	u, err := neturl.Parse(spec.Target)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid artifact target %q", spec.Target)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, errors.Errorf("invalid artifact target %q, expected s3://bucket/prefix", spec.Target)
+		}
+		return newS3Store(u.Host, u.Path, spec.Endpoint, uploadsPath)
+	case "file":
+		return newFSStore(u.Path)
+	case "":
+		return newFSStore(spec.Target)
+	default:
+		return nil, errors.Errorf("unsupported artifact target %q, expected s3:// or file://", spec.Target)
+	}
+}
+
+// fsStore keeps artifacts in a local or network mounted directory.
+type fsStore struct {
+	root string
+}
+
+func newFSStore(root string) (*fsStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to resolve %s", root)
+	}
+
+	return &fsStore{root: root}, nil
+}
+
+func (s *fsStore) String() string {
+	return s.root
+}
+
+func (s *fsStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *fsStore) exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithMessagef(err, "failed to stat %s", s.path(key))
+	}
+
+	return true, nil
+}
+
+func (s *fsStore) get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errArtifactNotFound
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to open %s", s.path(key))
+	}
+
+	return f, nil
+}
+
+func (s *fsStore) put(key string, r io.ReadSeeker, size int64, sum string) error {
+	dir := Path{path: filepath.Dir(s.path(key))}
+	if err := dir.mkdirIfNotExists(); err != nil {
+		return err
+	}
+
+	return copyToFileAtomic(s.path(key), r, 0o644, sum)
+}
+
+// copyToFileAtomic writes r to path through a temporary file and only puts it
+// in place if its content hashes to sum, when sum is given.
+func copyToFileAtomic(path string, r io.Reader, perm os.FileMode, sum string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create temporary file")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return errors.WithMessagef(err, "failed to write %s", tmp)
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return errors.WithMessagef(err, "failed to chmod %s", tmp)
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.WithMessagef(err, "failed to close %s", tmp)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); sum != "" && got != sum {
+		return errors.Errorf("checksum mismatch for %s: expected %s, got %s", path, sum, got)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.WithMessagef(err, "failed to rename %s to %s", tmp, path)
+	}
+
+	return nil
+}
+
+func objectKey(sum string) string {
+	return path.Join("objects", "sha256", sum[:2], sum)
+}
+
+func runIndexKey(projectName, experimentName, runName string) string {
+	return path.Join(projectName, experimentName, runName, "index.json")
+}
+
+type indexedFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+	Mode   fs.FileMode `json:"mode"`
+}
+
+type runIndex struct {
+	Project    string        `json:"project"`
+	Experiment string        `json:"experiment"`
+	Run        string        `json:"run"`
+	PushedAt   time.Time     `json:"pushed_at"`
+	Files      []indexedFile `json:"files"`
+}
+
+// check refuses an index whose hashes could not have come from a push, the
+// store is not trusted to hand out well formed object keys.
+func (index *runIndex) check() error {
+	for _, file := range index.Files {
+		if !isSHA256Hex(file.SHA256) {
+			return errors.Errorf("run index entry %s has an invalid sha256 %q", file.Path, file.SHA256)
+		}
+	}
+
+	return nil
+}
+
+func isSHA256Hex(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range sum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+type cachedHash struct {
+	Size       int64  `json:"size"`
+	ModifiedAt int64  `json:"modified_at"`
+	SHA256     string `json:"sha256"`
+}
+
+// hashCache remembers the hashes of the files of a run, so that unchanged
+// checkpoints are not read again on every push.
+type hashCache struct {
+	path    string
+	entries map[string]cachedHash
+}
+
+func loadHashCache(path string) *hashCache {
+	c := &hashCache{path: path, entries: map[string]cachedHash{}}
+
+	// a broken cache only costs rehashing
+	if content, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(content, &c.entries)
+	}
+
+	return c
+}
+
+func (c *hashCache) sum(root, rel string, info fs.FileInfo) (string, error) {
+	if cached, ok := c.entries[rel]; ok && cached.Size == info.Size() && cached.ModifiedAt == info.ModTime().UnixNano() {
+		return cached.SHA256, nil
+	}
+
+	sum, err := fileSHA256(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+
+	c.entries[rel] = cachedHash{Size: info.Size(), ModifiedAt: info.ModTime().UnixNano(), SHA256: sum}
+
+	return sum, nil
+}
+
+func (c *hashCache) save() error {
+	content, err := json.Marshal(c.entries)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode hash cache")
+	}
+
+	return writeFileAtomic(c.path, content, 0o644, true)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to open %s", path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// indexRunDir hashes every regular file of the run directory, the hash cache
+// itself is left out.
+func indexRunDir(runDir string, cache *hashCache) ([]indexedFile, error) {
+	var files []indexedFile
+	err := filepath.WalkDir(runDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == cache.path || d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(runDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			fmt.Printf("skipping %s, not a regular file\n", rel)
+			return nil
+		}
+
+		sum, err := cache.sum(runDir, rel, info)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, indexedFile{Path: rel, Size: info.Size(), SHA256: sum, Mode: info.Mode().Perm()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to index %s", runDir)
+	}
+
+	return files, nil
+}
+
+type SyncArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	RunName        string `validate:"required,varname"`
+	Target         string
+	Endpoint       string
+	CacheDir       string
+}
+
+// syncSetup resolves the layout and the store, flags override invoker.json.
+func syncSetup(args SyncArgs) (*Layout, artifactStore) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	spec := ArtifactsSpec{}
+	if cwd, err := os.Getwd(); err == nil {
+		config, err := loadProjectConfig(cwd)
+		if err != nil {
+			fmt.Printf("failed to load project config: %v\n", err)
+			os.Exit(1)
+		}
+		spec = config.Artifacts
+	}
+	if args.Target != "" {
+		spec.Target = args.Target
+	}
+	if args.Endpoint != "" {
+		spec.Endpoint = args.Endpoint
+	}
+
+	store, err := openArtifactStore(spec, layout.UploadsPath())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return layout, store
+}
+
+// Push uploads a run directory. Files already in the store are skipped, so
+// an interrupted push picks up where it stopped.
+func Push(args SyncArgs) {
+	layout, store := syncSetup(args)
+
+	runDir := layout.RunDir(args.ProjectName, args.ExperimentName, args.RunName)
+	if _, err := os.Stat(runDir); err != nil {
+		fmt.Printf("run %s of experiment %s not found in %s\n", args.RunName, args.ExperimentName, layout.ExperimentDir(args.ProjectName, args.ExperimentName))
+		os.Exit(1)
+	}
+
+	cache := loadHashCache(layout.RunHashCachePath(args.ProjectName, args.ExperimentName, args.RunName))
+	files, err := indexRunDir(runDir, cache)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cache.save(); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+
+	if s3, ok := store.(*s3Store); ok {
+		if err := s3.abortStaleUploads(time.Now()); err != nil {
+			fmt.Printf("warning: failed to abort stale multipart uploads: %v\n", err)
+		}
+	}
+
+	var uploaded, skipped int64
+	for _, file := range files {
+		key := objectKey(file.SHA256)
+		exists, err := store.exists(key)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if exists {
+			skipped += file.Size
+			continue
+		}
+
+		fmt.Printf("uploading %s (%s)\n", file.Path, units.BytesSize(float64(file.Size)))
+		if err := putFile(store, key, filepath.Join(runDir, filepath.FromSlash(file.Path)), file); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		uploaded += file.Size
+	}
+
+	index := runIndex{
+		Project:    args.ProjectName,
+		Experiment: args.ExperimentName,
+		Run:        args.RunName,
+		PushedAt:   time.Now(),
+		Files:      files,
+	}
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(content)
+	if err := store.put(runIndexKey(args.ProjectName, args.ExperimentName, args.RunName), bytes.NewReader(content), int64(len(content)), hex.EncodeToString(sum[:])); err != nil {
+		fmt.Printf("failed to upload run index: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("pushed %s to %s: %d files, %s uploaded, %s already there\n",
+		args.RunName, store, len(files), units.BytesSize(float64(uploaded)), units.BytesSize(float64(skipped)))
+}
+
+func putFile(store artifactStore, key, path string, file indexedFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to open %s", path)
+	}
+	defer f.Close()
+
+	return errors.WithMessagef(store.put(key, f, file.Size, file.SHA256), "failed to upload %s", file.Path)
+}
+
+// Pull restores a run directory from the store, e.g. on another host before
+// resuming it. Files that are already present with the right content are
+// kept, everything else is downloaded and verified against its hash.
+func Pull(args SyncArgs) {
+	layout, store := syncSetup(args)
+
+	r, err := store.get(runIndexKey(args.ProjectName, args.ExperimentName, args.RunName))
+	if err == errArtifactNotFound {
+		fmt.Printf("run %s of experiment %s was never pushed to %s\n", args.RunName, args.ExperimentName, store)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var index runIndex
+	err = json.NewDecoder(r).Decode(&index)
+	r.Close()
+	if err != nil {
+		fmt.Printf("failed to parse run index: %v\n", err)
+		os.Exit(1)
+	}
+	if err := index.check(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	runDir := layout.RunDir(args.ProjectName, args.ExperimentName, args.RunName)
+	if err := layout.MakeRunDirs(args.ProjectName, args.ExperimentName, args.RunName); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cache := loadHashCache(layout.RunHashCachePath(args.ProjectName, args.ExperimentName, args.RunName))
+	defer func() {
+		if err := cache.save(); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+	}()
+
+	var downloaded, kept int64
+	for _, file := range index.Files {
+		if clean := path.Clean(file.Path); clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+			fmt.Printf("refusing to restore %s outside of the run directory\n", file.Path)
+			os.Exit(1)
+		}
+
+		local := filepath.Join(runDir, filepath.FromSlash(file.Path))
+		if info, err := os.Stat(local); err == nil && info.Mode().IsRegular() {
+			if sum, err := cache.sum(runDir, file.Path, info); err == nil && sum == file.SHA256 {
+				kept += file.Size
+				continue
+			}
+		}
+
+		fmt.Printf("downloading %s (%s)\n", file.Path, units.BytesSize(float64(file.Size)))
+		if err := getFile(store, local, file); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		downloaded += file.Size
+	}
+
+	fmt.Printf("pulled %s from %s into %s: %d files, %s downloaded, %s already there\n",
+		args.RunName, store, runDir, len(index.Files), units.BytesSize(float64(downloaded)), units.BytesSize(float64(kept)))
+}
+
+func getFile(store artifactStore, local string, file indexedFile) error {
+	r, err := store.get(objectKey(file.SHA256))
+	if err == errArtifactNotFound {
+		return errors.Errorf("%s is missing from the store", file.Path)
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir := Path{path: filepath.Dir(local)}
+	if err := dir.mkdirIfNotExists(); err != nil {
+		return err
+	}
+
+	mode := file.Mode
+	if mode == 0 {
+		mode = 0o644
+	}
+
+	return errors.WithMessagef(copyToFileAtomic(local, r, mode, file.SHA256), "failed to download %s", file.Path)
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunIndexCheck(t *testing.T) {
+	good := strings.Repeat("ab", 32)
+	tests := []struct {
+		sum string
+		ok  bool
+	}{
+		{good, true},
+		{"", false},
+		{"a", false},
+		{good[:62], false},
+		{strings.ToUpper(good), false},
+		{"../" + good[3:], false},
+		{good + "00", false},
+	}
+
+	for _, tt := range tests {
+		index := runIndex{Files: []indexedFile{{Path: "logs/out.txt", SHA256: good}, {Path: "model.pt", SHA256: tt.sum}}}
+		err := index.check()
+		if (err == nil) != tt.ok {
+			t.Errorf("check with sha256 %q: %v", tt.sum, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "model.pt") {
+			t.Errorf("error %q does not name the entry", err)
+		}
+	}
+}
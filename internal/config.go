@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ProjectConfigFile is read from the project root, every field is optional.
+const ProjectConfigFile = "invoker.json"
+
+type ProjectConfig struct {
+	// Mounts are added to every run of the project, e.g. datasets. Relative
+	// bind sources are resolved against the project root.
+	Mounts []MountSpec `json:"mounts,omitempty"`
+	// Resources are the defaults for every run, flags override them.
+	Resources ResourceSpec `json:"resources,omitempty"`
+	Security  SecuritySpec `json:"security,omitempty"`
+	// Artifacts is where run push and run pull sync runs to.
+	Artifacts ArtifactsSpec `json:"artifacts,omitempty"`
+}
+
+func loadProjectConfig(root string) (ProjectConfig, error) {
+	var config ProjectConfig
+
+	path := filepath.Join(root, ProjectConfigFile)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	for i := range config.Mounts {
+		m := &config.Mounts[i]
+		if m.Type == mountTypeBind && m.Source != "" && !filepath.IsAbs(m.Source) {
+			m.Source = filepath.Join(root, m.Source)
+		}
+	}
+
+	return config, nil
+}
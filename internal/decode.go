@@ -5,31 +5,122 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
-func DecodeSecrets(secrets string) {
+type DecodeSecretsArgs struct {
+	Secrets string
+	Input   string
+	KeyFile string
+	Output  string
+	Force   bool
+}
+
+func DecodeSecrets(args DecodeSecretsArgs) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		fmt.Printf("failed to get current working directory: %v\n", err)
 		os.Exit(1)
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(secrets)
-
+	payload, err := readSecretsPayload(args.Secrets, args.Input)
 	if err != nil {
-		fmt.Printf("failed to decode base64 string: %v\n", err)
+		fmt.Printf("failed to read secrets: %v\n", err)
+		os.Exit(1)
 	}
+	secrets := strings.TrimSpace(string(payload))
 
-	f, err := os.Create(filepath.Join(cwd, "env"))
+	key, err := loadSecretsKey(args.KeyFile)
 	if err != nil {
-		fmt.Printf("failed to create env file: %v\n", err)
+		fmt.Printf("failed to load key: %v\n", err)
 		os.Exit(1)
 	}
-	defer f.Close()
 
-	_, err = f.Write(decoded)
-	if err != nil {
-		fmt.Printf("failed to write to env file: %v\n", err)
+	var decoded []byte
+	if isEncryptedSecrets(secrets) {
+		if key == nil {
+			fmt.Printf("secrets are encrypted, use --key_file or set %s\n", secretsKeyEnv)
+			os.Exit(1)
+		}
+
+		decoded, err = decryptSecrets(secrets, key)
+		if err != nil {
+			fmt.Printf("failed to decrypt secrets: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(secrets)
+
+		if err != nil {
+			fmt.Printf("failed to decode base64 string: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := validateDotenv(decoded); err != nil {
+		fmt.Printf("decoded secrets are not a valid env file: %v\n", err)
+		os.Exit(1)
+	}
+
+	output := args.Output
+	if output == "" {
+		output = "env"
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(cwd, output)
+	}
+
+	if err := writeFileAtomic(output, decoded, 0o600, args.Force); err != nil {
+		fmt.Printf("failed to write env file: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// writeFileAtomic writes content to a temporary file next to path and renames
+// it over path, so readers never observe a partially written file. Without
+// overwrite the file is linked to path instead, which fails if path exists,
+// also when it is created in the meantime.
+func writeFileAtomic(path string, content []byte, perm os.FileMode, overwrite bool) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create temporary file")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return errors.WithMessagef(err, "failed to chmod %s", tmp)
+	}
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return errors.WithMessagef(err, "failed to write %s", tmp)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.WithMessagef(err, "failed to sync %s", tmp)
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.WithMessagef(err, "failed to close %s", tmp)
+	}
+
+	if !overwrite {
+		if err := os.Link(tmp, path); os.IsExist(err) {
+			return errors.Errorf("%s already exists, use --force to overwrite it", path)
+		} else if err != nil {
+			return errors.WithMessagef(err, "failed to link %s to %s", tmp, path)
+		}
+		return nil
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.WithMessagef(err, "failed to rename %s to %s", tmp, path)
+	}
+
+	return nil
+}
@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+// devRootEnv points device discovery at another root than /, e.g. a fake
+// /dev, /sys and /proc tree. Providers take the root as a parameter.
+const devRootEnv = "INVOKER_DEV_ROOT"
+
+// devRoot is the directory device paths are resolved against.
+func devRoot() string {
+	return valueOr(os.Getenv(devRootEnv), "/")
+}
+
+const maxAccelerators = 32
+
+// deviceContribution is what a provider adds to the container spec.
+type deviceContribution struct {
+	Mappings []container.DeviceMapping
+	Requests []container.DeviceRequest
+	Env      []string
+}
+
+// acceleratorProvider discovers one kind of accelerator on the host and knows
+// how to expose it to a container. Accelerators are identified by index, the
+// same numbering --gpus uses.
+type acceleratorProvider interface {
+	Name() string
+	// Indices lists the accelerators present under root.
+	Indices(root string) []int
+	// Path is the device node of the accelerator with the given index.
+	Path(index int) string
+	// Contribute returns the container additions for the selected
+	// accelerators, nil meaning all of them.
+	Contribute(root string, selected []int, access deviceAccess) deviceContribution
+	// LocalCPUs returns the cpu list of the NUMA node the accelerator is
+	// attached to.
+	LocalCPUs(root string, index int) (string, error)
+}
+
+// deviceAccess is how the container gets to its accelerators.
+type deviceAccess struct {
+	// Requests tells whether a container runtime hook may be asked for the
+	// devices, instead of relying on plain device mappings only.
+	Requests bool
+	// Privileged containers see every device of the host, whatever is mapped
+	// or requested, so the selection has to be made by the host numbering.
+	Privileged bool
+}
+
+var acceleratorProviders = []acceleratorProvider{
+	nvidiaProvider{},
+	rocmProvider{},
+	habanaProvider{},
+}
+
+// detectAccelerator returns the provider called name, or with name "auto"
+// the first one that finds devices under root.
+func detectAccelerator(root, name string) (acceleratorProvider, error) {
+	switch name {
+	case "", "auto":
+		for _, p := range acceleratorProviders {
+			if len(p.Indices(root)) > 0 {
+				return p, nil
+			}
+		}
+		return noneProvider{}, nil
+	case "none":
+		return noneProvider{}, nil
+	}
+
+	for _, p := range acceleratorProviders {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+
+	names := []string{"auto", "none"}
+	for _, p := range acceleratorProviders {
+		names = append(names, p.Name())
+	}
+	return nil, errors.Errorf("unknown accelerator %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+func hostPath(root, path string) string {
+	return filepath.Join(root, path)
+}
+
+func existingPaths(root string, paths []string) []string {
+	existing := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, err := os.Stat(hostPath(root, path)); err == nil {
+			existing = append(existing, path)
+		}
+	}
+
+	return existing
+}
+
+func probeIndices(root string, path func(int) string) []int {
+	indices := make([]int, 0, maxAccelerators)
+	for i := 0; i < maxAccelerators; i++ {
+		if _, err := os.Stat(hostPath(root, path(i))); err == nil {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+func selectedOrAll(p acceleratorProvider, root string, selected []int) []int {
+	if selected == nil {
+		return p.Indices(root)
+	}
+
+	return selected
+}
+
+func createDeviceMapping(devices []string) []container.DeviceMapping {
+	mappings := make([]container.DeviceMapping, 0, len(devices))
+	for _, path := range devices {
+		mappings = append(mappings, container.DeviceMapping{
+			PathOnHost:        path,
+			PathInContainer:   path,
+			CgroupPermissions: "rwm",
+		})
+	}
+	return mappings
+}
+
+// checkAcceleratorsPresent makes sure every selected accelerator exists.
+func checkAcceleratorsPresent(p acceleratorProvider, root string, selected []int) error {
+	present := make(map[int]bool)
+	for _, index := range p.Indices(root) {
+		present[index] = true
+	}
+
+	for _, index := range selected {
+		if !present[index] {
+			return errors.Errorf("%s device %d is not present on this host (%s not found)", p.Name(), index, p.Path(index))
+		}
+	}
+
+	return nil
+}
+
+type nvidiaProvider struct{}
+
+var otherNvidiaDevices = []string{
+	"/dev/nvidia-uvm",
+	"/dev/nvidiactl",
+
+	// not really sure if we need these
+	"/dev/nvidia-modeset",
+	"/dev/nvidia-uvm-tools",
+}
+
+func (nvidiaProvider) Name() string { return "nvidia" }
+
+func (nvidiaProvider) Path(index int) string {
+	return fmt.Sprintf("/dev/nvidia%d", index)
+}
+
+func (p nvidiaProvider) Indices(root string) []int {
+	// we just need to check whether /dev/nvidia%d exists
+	return probeIndices(root, p.Path)
+}
+
+func (p nvidiaProvider) Contribute(root string, selected []int, access deviceAccess) deviceContribution {
+	var c deviceContribution
+
+	if access.Requests {
+		request := container.DeviceRequest{Count: -1, Capabilities: [][]string{{"gpu"}}}
+		if selected != nil {
+			request = container.DeviceRequest{
+				DeviceIDs:    strings.Split(joinInts(selected), ","),
+				Capabilities: [][]string{{"gpu"}},
+			}
+		}
+		c.Requests = append(c.Requests, request)
+	}
+
+	if selected != nil {
+		c.Env = append(c.Env, "CUDA_VISIBLE_DEVICES="+cudaVisibleDevices(selected, access.Requests && !access.Privileged))
+	}
+
+	// usually there's no need to add additional devices on bare-metal
+	// but with tcpx setup we need to add other nvidia-ish devices
+	paths := make([]string, 0, maxAccelerators)
+	for _, index := range selectedOrAll(p, root, selected) {
+		paths = append(paths, p.Path(index))
+	}
+	c.Mappings = append(c.Mappings, createDeviceMapping(paths)...)
+	c.Mappings = append(c.Mappings, createDeviceMapping(existingPaths(root, otherNvidiaDevices))...)
+
+	return c
+}
+
+// LocalCPUs finds the PCI address of the GPU through the driver's proc
+// interface, which lists the device minor of every GPU.
+func (nvidiaProvider) LocalCPUs(root string, index int) (string, error) {
+	infos, _ := filepath.Glob(hostPath(root, "/proc/driver/nvidia/gpus/*/information"))
+	for _, info := range infos {
+		content, err := os.ReadFile(info)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			if strings.TrimSpace(key) != "Device Minor" || strings.TrimSpace(value) != strconv.Itoa(index) {
+				continue
+			}
+
+			busID := strings.ToLower(filepath.Base(filepath.Dir(info)))
+			return readCPUList(hostPath(root, "/sys/bus/pci/devices/"+busID+"/local_cpulist"))
+		}
+	}
+
+	return "", errors.Errorf("gpu %d not found in /proc/driver/nvidia/gpus", index)
+}
+
+// cudaVisibleDevices numbers the selected GPUs the way CUDA sees them inside
+// the container. The nvidia runtime renumbers requested devices from zero,
+// while plain device mappings and privileged containers, which see all GPUs
+// anyway, keep the host numbering.
+func cudaVisibleDevices(gpus []int, fromZero bool) string {
+	if !fromZero {
+		return joinInts(gpus)
+	}
+
+	renumbered := make([]int, len(gpus))
+	for i := range gpus {
+		renumbered[i] = i
+	}
+
+	return joinInts(renumbered)
+}
+
+// rocmProvider exposes AMD GPUs through /dev/kfd and one DRM render node per
+// GPU. GPUs are numbered in render node order, so renderD128 is 0.
+type rocmProvider struct{}
+
+const firstRenderNode = 128
+
+func (rocmProvider) Name() string { return "rocm" }
+
+func (rocmProvider) Path(index int) string {
+	return fmt.Sprintf("/dev/dri/renderD%d", firstRenderNode+index)
+}
+
+func (p rocmProvider) Indices(root string) []int {
+	if _, err := os.Stat(hostPath(root, "/dev/kfd")); err != nil {
+		return nil
+	}
+
+	matches, _ := filepath.Glob(hostPath(root, "/dev/dri/renderD*"))
+	indices := make([]int, 0, len(matches))
+	for _, match := range matches {
+		minor, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(match), "renderD"))
+		if err == nil && minor >= firstRenderNode {
+			indices = append(indices, minor-firstRenderNode)
+		}
+	}
+	sort.Ints(indices)
+
+	return indices
+}
+
+func (p rocmProvider) Contribute(root string, selected []int, access deviceAccess) deviceContribution {
+	paths := []string{"/dev/kfd"}
+	for _, index := range selectedOrAll(p, root, selected) {
+		paths = append(paths, p.Path(index))
+	}
+	c := deviceContribution{Mappings: createDeviceMapping(paths)}
+
+	// the ROCm runtime only sees the render nodes mapped into the container,
+	// unless it is privileged and sees all of them in host order
+	if access.Privileged && selected != nil {
+		c.Env = append(c.Env, "ROCR_VISIBLE_DEVICES="+joinInts(selected))
+	}
+
+	return c
+}
+
+func (p rocmProvider) LocalCPUs(root string, index int) (string, error) {
+	return readCPUList(hostPath(root, fmt.Sprintf("/sys/class/drm/renderD%d/device/local_cpulist", firstRenderNode+index)))
+}
+
+// habanaProvider exposes Gaudi accelerators through /dev/accel/accelN and
+// their control nodes.
+type habanaProvider struct{}
+
+func (habanaProvider) Name() string { return "habana" }
+
+func (habanaProvider) Path(index int) string {
+	return fmt.Sprintf("/dev/accel/accel%d", index)
+}
+
+func (p habanaProvider) Indices(root string) []int {
+	return probeIndices(root, p.Path)
+}
+
+func (p habanaProvider) Contribute(root string, selected []int, _ deviceAccess) deviceContribution {
+	indices := selectedOrAll(p, root, selected)
+
+	paths := make([]string, 0, 2*len(indices))
+	for _, index := range indices {
+		paths = append(paths, p.Path(index))
+		paths = append(paths, existingPaths(root, []string{fmt.Sprintf("/dev/accel/accel_controlD%d", index)})...)
+	}
+
+	visible := "all"
+	if selected != nil {
+		visible = joinInts(selected)
+	}
+
+	return deviceContribution{
+		Mappings: createDeviceMapping(paths),
+		// read by the habana container runtime, harmless without it
+		Env: []string{"HABANA_VISIBLE_DEVICES=" + visible},
+	}
+}
+
+func (habanaProvider) LocalCPUs(root string, index int) (string, error) {
+	return readCPUList(hostPath(root, fmt.Sprintf("/sys/class/accel/accel%d/device/local_cpulist", index)))
+}
+
+type noneProvider struct{}
+
+func (noneProvider) Name() string { return "none" }
+
+func (noneProvider) Path(index int) string { return "" }
+
+func (noneProvider) Indices(string) []int { return nil }
+
+func (noneProvider) Contribute(string, []int, deviceAccess) deviceContribution {
+	return deviceContribution{}
+}
+
+func (noneProvider) LocalCPUs(string, int) (string, error) {
+	return "", errors.New("no accelerators")
+}
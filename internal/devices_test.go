@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeRoot creates the given files under a temporary root, with their
+// contents, and returns the root.
+func fakeRoot(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for path, content := range files {
+		full := hostPath(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func mappedPaths(c deviceContribution) []string {
+	paths := make([]string, 0, len(c.Mappings))
+	for _, m := range c.Mappings {
+		paths = append(paths, m.PathOnHost)
+	}
+
+	return paths
+}
+
+func TestProviderIndices(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"/dev/nvidia0":               "",
+		"/dev/nvidia2":               "",
+		"/dev/nvidiactl":             "",
+		"/dev/kfd":                   "",
+		"/dev/dri/card0":             "",
+		"/dev/dri/renderD128":        "",
+		"/dev/dri/renderD129":        "",
+		"/dev/accel/accel1":          "",
+		"/dev/accel/accel_controlD1": "",
+		"/dev/accel/accel_controlD7": "",
+	})
+
+	tests := []struct {
+		provider acceleratorProvider
+		want     []int
+	}{
+		{nvidiaProvider{}, []int{0, 2}},
+		{rocmProvider{}, []int{0, 1}},
+		{habanaProvider{}, []int{1}},
+		{noneProvider{}, nil},
+	}
+
+	for _, tt := range tests {
+		if got := tt.provider.Indices(root); !reflect.DeepEqual(got, tt.want) && !(len(got) == 0 && len(tt.want) == 0) {
+			t.Errorf("%s: Indices() = %v, want %v", tt.provider.Name(), got, tt.want)
+		}
+	}
+}
+
+func TestDetectAccelerator(t *testing.T) {
+	nvidia := fakeRoot(t, map[string]string{"/dev/nvidia0": "", "/dev/dri/renderD128": ""})
+	rocm := fakeRoot(t, map[string]string{"/dev/kfd": "", "/dev/dri/renderD128": ""})
+	empty := t.TempDir()
+
+	tests := []struct {
+		root    string
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{nvidia, "auto", "nvidia", false},
+		{rocm, "auto", "rocm", false},
+		{empty, "", "none", false},
+		{empty, "habana", "habana", false},
+		{nvidia, "none", "none", false},
+		{empty, "tpu", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := detectAccelerator(tt.root, tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("detectAccelerator(%q) succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("detectAccelerator(%q): %v", tt.name, err)
+			continue
+		}
+		if got.Name() != tt.want {
+			t.Errorf("detectAccelerator(%q) = %s, want %s", tt.name, got.Name(), tt.want)
+		}
+	}
+}
+
+func TestCheckAcceleratorsPresent(t *testing.T) {
+	root := fakeRoot(t, map[string]string{"/dev/nvidia0": "", "/dev/nvidia1": ""})
+
+	if err := checkAcceleratorsPresent(nvidiaProvider{}, root, []int{0, 1}); err != nil {
+		t.Errorf("present gpus: %v", err)
+	}
+	if err := checkAcceleratorsPresent(nvidiaProvider{}, root, []int{1, 4}); err == nil {
+		t.Error("missing gpu 4 was not reported")
+	}
+}
+
+func TestNvidiaContribute(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"/dev/nvidia0":    "",
+		"/dev/nvidia1":    "",
+		"/dev/nvidia4":    "",
+		"/dev/nvidia5":    "",
+		"/dev/nvidiactl":  "",
+		"/dev/nvidia-uvm": "",
+	})
+
+	tests := []struct {
+		name         string
+		selected     []int
+		access       deviceAccess
+		wantEnv      []string
+		wantRequests int
+	}{
+		{"hardened requests renumber", []int{4, 5}, deviceAccess{Requests: true}, []string{"CUDA_VISIBLE_DEVICES=0,1"}, 1},
+		{"privileged requests keep host indices", []int{4, 5}, deviceAccess{Requests: true, Privileged: true}, []string{"CUDA_VISIBLE_DEVICES=4,5"}, 1},
+		{"mappings keep host indices", []int{4, 5}, deviceAccess{}, []string{"CUDA_VISIBLE_DEVICES=4,5"}, 0},
+		{"all gpus", nil, deviceAccess{Requests: true}, nil, 1},
+	}
+
+	for _, tt := range tests {
+		c := nvidiaProvider{}.Contribute(root, tt.selected, tt.access)
+		if !reflect.DeepEqual(c.Env, tt.wantEnv) {
+			t.Errorf("%s: env = %v, want %v", tt.name, c.Env, tt.wantEnv)
+		}
+		if len(c.Requests) != tt.wantRequests {
+			t.Errorf("%s: %d device requests, want %d", tt.name, len(c.Requests), tt.wantRequests)
+		}
+	}
+
+	c := nvidiaProvider{}.Contribute(root, []int{4}, deviceAccess{})
+	want := []string{"/dev/nvidia4", "/dev/nvidia-uvm", "/dev/nvidiactl"}
+	if got := mappedPaths(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("mappings = %v, want %v", got, want)
+	}
+
+	c = nvidiaProvider{}.Contribute(root, nil, deviceAccess{})
+	want = []string{"/dev/nvidia0", "/dev/nvidia1", "/dev/nvidia4", "/dev/nvidia5", "/dev/nvidia-uvm", "/dev/nvidiactl"}
+	if got := mappedPaths(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("mappings of all gpus = %v, want %v", got, want)
+	}
+}
+
+func TestRocmContribute(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"/dev/kfd":            "",
+		"/dev/dri/renderD128": "",
+		"/dev/dri/renderD129": "",
+	})
+
+	c := rocmProvider{}.Contribute(root, []int{1}, deviceAccess{})
+	if want := []string{"/dev/kfd", "/dev/dri/renderD129"}; !reflect.DeepEqual(mappedPaths(c), want) {
+		t.Errorf("mappings = %v, want %v", mappedPaths(c), want)
+	}
+	if len(c.Env) != 0 {
+		t.Errorf("env = %v, want none", c.Env)
+	}
+
+	c = rocmProvider{}.Contribute(root, []int{1}, deviceAccess{Privileged: true})
+	if want := []string{"ROCR_VISIBLE_DEVICES=1"}; !reflect.DeepEqual(c.Env, want) {
+		t.Errorf("privileged env = %v, want %v", c.Env, want)
+	}
+}
+
+func TestHabanaContribute(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"/dev/accel/accel0":          "",
+		"/dev/accel/accel1":          "",
+		"/dev/accel/accel_controlD1": "",
+	})
+
+	c := habanaProvider{}.Contribute(root, []int{1}, deviceAccess{})
+	if want := []string{"/dev/accel/accel1", "/dev/accel/accel_controlD1"}; !reflect.DeepEqual(mappedPaths(c), want) {
+		t.Errorf("mappings = %v, want %v", mappedPaths(c), want)
+	}
+	if want := []string{"HABANA_VISIBLE_DEVICES=1"}; !reflect.DeepEqual(c.Env, want) {
+		t.Errorf("env = %v, want %v", c.Env, want)
+	}
+}
+
+func TestNUMACPUSet(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"/dev/nvidia0": "",
+		"/dev/nvidia1": "",
+		"/proc/driver/nvidia/gpus/0000:3B:00.0/information": "Model: A100\nDevice Minor: 0\n",
+		"/proc/driver/nvidia/gpus/0000:86:00.0/information": "Model: A100\nDevice Minor: 1\n",
+		"/sys/bus/pci/devices/0000:3b:00.0/local_cpulist":   "0-3,8\n",
+		"/sys/bus/pci/devices/0000:86:00.0/local_cpulist":   "4-7\n",
+	})
+
+	tests := []struct {
+		selected    []int
+		wantPerRank []string
+		want        string
+	}{
+		{[]int{0}, []string{"0-3,8"}, "0-3,8"},
+		{[]int{1, 0}, []string{"4-7", "0-3,8"}, "0-8"},
+		{nil, []string{"0-3,8", "4-7"}, "0-8"},
+	}
+
+	for _, tt := range tests {
+		perRank, got, err := numaCPUSets(nvidiaProvider{}, root, tt.selected)
+		if err != nil {
+			t.Errorf("numaCPUSets(%v): %v", tt.selected, err)
+			continue
+		}
+		if got != tt.want || !reflect.DeepEqual(perRank, tt.wantPerRank) {
+			t.Errorf("numaCPUSets(%v) = %v, %s, want %v, %s", tt.selected, perRank, got, tt.wantPerRank, tt.want)
+		}
+	}
+
+	if _, _, err := numaCPUSets(rocmProvider{}, root, []int{0}); err == nil {
+		t.Error("numaCPUSets without a local_cpulist succeeded")
+	}
+}
+
+func TestDevRoot(t *testing.T) {
+	t.Setenv(devRootEnv, "")
+	if got := devRoot(); got != "/" {
+		t.Errorf("devRoot() = %s, want /", got)
+	}
+
+	root := fakeRoot(t, map[string]string{"/dev/nvidia3": ""})
+	t.Setenv(devRootEnv, root)
+	if got := (nvidiaProvider{}).Indices(devRoot()); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("Indices(devRoot()) = %v, want [3]", got)
+	}
+}
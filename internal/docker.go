@@ -1,19 +1,21 @@
 package internal
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
-	units "github.com/docker/go-units"
 	"github.com/pkg/errors"
 )
 
@@ -26,50 +28,58 @@ type DockerRun struct {
 	guestProjectCachePath string
 	imageTag              string
 	hostRootPath          string
-	hostCachePath         string
+	hostProjectCachePath  string
+	layout                *Layout
 	hostGID               int
 	hostUID               int
+	devRoot               string
+	endpoint              DockerEndpoint
 }
 
+// labels put on every container started by invoker
+const (
+	labelInvoker    = "higgsfield.invoker"
+	labelProject    = "higgsfield.project"
+	labelExperiment = "higgsfield.experiment"
+	labelRun        = "higgsfield.run"
+	labelGPUs       = "higgsfield.gpus"
+	labelSecurity   = "higgsfield.security"
+	labelGitCommit  = "higgsfield.git.commit"
+	labelGitDirty   = "higgsfield.git.dirty"
+
+	gpuLabelAll = "all"
+)
+
 const (
 	imageTag           = "hf-torch:latest"
 	guestRootPath      = "/srv/"
 	guestCachePath     = "/home/nonroot/.cache/"
 	guestRootCachePath = "/root/.cache/"
+	// the project part of the cache root is all containers get of it, next
+	// to sharedCacheSubdirs
+	guestCacheSubdir = "higgsfield/"
 )
 
-func isCos() (bool, error) {
-	file, err := os.Open("/etc/os-release")
-	if err != nil {
-		return false, fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "ID=") {
-			id := strings.TrimPrefix(line, "ID=")
-			return id == "cos", nil
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return false, fmt.Errorf("failed to scan file: %w", err)
-	}
-
-	return false, nil
-}
+// sharedCacheSubdirs of the cache root are bound into every container unless
+// the run isolates its caches, so that downloaded models and datasets are
+// kept between runs: the hugging face hub and datasets, and the torch hub.
+var sharedCacheSubdirs = []string{"huggingface", "torch"}
 
 func NewDockerRun(
 	ctx context.Context,
 	projectName,
-	hostRootPath,
-	hostCachePath string,
-) *DockerRun {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	hostRootPath string,
+	layout *Layout,
+	endpoint DockerEndpoint,
+) (*DockerRun, error) {
+	opts, err := endpoint.clientOptions()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to create docker client for %s", endpoint)
 	}
 	defer cli.Close()
 
@@ -82,89 +92,129 @@ func NewDockerRun(
 		projectName:           projectName,
 		guestRootPath:         guestRootPath,
 		guestCachePath:        guestCachePath,
-		guestProjectCachePath: guestCachePath + projectName,
+		guestProjectCachePath: guestCachePath + guestCacheSubdir + projectName,
 		imageTag:              imageTag,
 		hostRootPath:          hostRootPath,
-		hostCachePath:         hostCachePath,
+		hostProjectCachePath:  layout.ProjectDir(projectName),
+		layout:                layout,
 		hostGID:               hostGID,
 		hostUID:               hostUID,
+		devRoot:               devRoot(),
+		endpoint:              endpoint,
+	}, nil
+}
+
+// runningContainerNames lists the names of the running containers on the
+// local docker daemon.
+func runningContainerNames(ctx context.Context) (map[string]bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create docker client")
 	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list containers")
+	}
+
+	names := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		for _, name := range c.Names {
+			names[strings.TrimPrefix(name, "/")] = true
+		}
+	}
+
+	return names, nil
 }
 
 func DefaultProjExpContainerName(projectName, experimentName string) string {
 	return fmt.Sprintf("%s-%s", projectName, experimentName)
 }
 
+// Kill removes the container of exactly this name. The name filter of docker
+// matches substrings, which would take the containers of e.g. sweep points
+// along.
 func (d *DockerRun) Kill(containerName string) error {
-	options := types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("name", containerName))}
+	_, err := d.kill(containerName, "^/?"+regexp.QuoteMeta(containerName)+"$")
+	return err
+}
+
+// KillRuns removes the container of this name and those of the runs under
+// it, named <containerName>-<run> like sweep points, and returns the names
+// of the removed containers.
+func (d *DockerRun) KillRuns(containerName string) ([]string, error) {
+	return d.kill(containerName, "^/?"+regexp.QuoteMeta(containerName)+"(-.+)?$")
+}
+
+func (d *DockerRun) kill(containerName, nameFilter string) ([]string, error) {
+	options := types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("name", nameFilter))}
 
 	containers, err := d.client.ContainerList(d.ctx, options)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to list containers with name %s", containerName)
+		return nil, errors.WithMessagef(err, "failed to list containers with name %s", containerName)
 	}
 
 	fmt.Printf("found %d containers with name %s\n", len(containers), containerName)
 
+	var removed []string
+
 	for _, c := range containers {
-		if c.Status == "running" {
+		running := c.State == "running"
+		if running {
 			fmt.Printf("stopping container %s\n", c.ID)
 			if err := d.client.ContainerStop(d.ctx, c.ID, container.StopOptions{Timeout: PtrTo(0)}); err != nil {
 				fmt.Printf("failed to stop container %s, reason: %v", c.ID, err)
 			}
 		}
 
+		if info, err := d.client.ContainerInspect(d.ctx, c.ID); err == nil {
+			if err := d.finalizeRunManifest(info, running); err != nil {
+				fmt.Printf("failed to update run manifest: %v\n", err)
+			}
+		}
+
 		fmt.Printf("removing container %s\n", c.ID)
 		if err := d.client.ContainerRemove(d.ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-			return errors.WithMessagef(err, "failed to remove container %s", c.ID)
+			return removed, errors.WithMessagef(err, "failed to remove container %s", c.ID)
 		}
-	}
-
-	return nil
-}
-
-var otherNvidiaDevices = []string{
-	"/dev/nvidia-uvm",
-	"/dev/nvidiactl",
-
-	// not really sure if we need these
-	"/dev/nvidia-modeset",
-	"/dev/nvidia-uvm-tools",
-}
-
-func listOtherNvidiaDevices() []string {
-	devices := make([]string, 0, len(otherNvidiaDevices))
-	for _, path := range otherNvidiaDevices {
-		if _, err := os.Stat(path); err == nil {
-			devices = append(devices, path)
+		if len(c.Names) > 0 {
+			removed = append(removed, strings.TrimPrefix(c.Names[0], "/"))
 		}
 	}
 
-	return devices
+	return removed, nil
 }
 
-func listNvidiaGPUs() []string {
-	gpus := make([]string, 0, 32)
-	// we just need to check whether /dev/nvidia%d exists
-	for i := 0; i < 32; i++ {
-		path := fmt.Sprintf("/dev/nvidia%d", i)
-		if _, err := os.Stat(path); err == nil {
-			gpus = append(gpus, path)
-		}
-	}
-
-	return gpus
-}
-
-func createDeviceMapping(devices []string) []container.DeviceMapping {
-	mappings := make([]container.DeviceMapping, 0, len(devices))
-	for _, path := range devices {
-		mappings = append(mappings, container.DeviceMapping{
-			PathOnHost:        path,
-			PathInContainer:   path,
-			CgroupPermissions: "rwm",
-		})
-	}
-	return mappings
+type RunOptions struct {
+	Profile     HostProfile
+	Accelerator acceleratorProvider
+	// GPUs selects the host accelerators given to the container.
+	GPUs gpuRequest
+	// GPUWait is how long to wait for enough free GPUs when they are
+	// allocated automatically.
+	GPUWait time.Duration
+	// Mounts are added next to the project and cache binds.
+	Mounts    []mount.Mount
+	Resources containerResources
+	Security  containerSecurity
+	Labels    map[string]string
+	// Git is the state of the project tree the image is built from, nil
+	// outside of a git repository.
+	Git *GitInfo
+	// Image is used instead of building the project when set, e.g. the
+	// image ID of the run being resumed.
+	Image string
+	// Env is added to the environment of the container.
+	Env []string
+	// ProjectDir is bound into the container instead of the directory the
+	// image is built from, e.g. where the project is on a remote host.
+	ProjectDir string
+	// SharedCaches binds the sharedCacheSubdirs of the cache root as well.
+	SharedCaches bool
 }
 
 func (d *DockerRun) Run(
@@ -172,13 +222,57 @@ func (d *DockerRun) Run(
 	runCommand string,
 	runCommandArgs []string,
 	exposePort int,
-) error {
+	opts RunOptions,
+) (types.ContainerJSON, error) {
+	var info types.ContainerJSON
 
 	fmt.Printf("killing container %s\n", containerName)
 	if err := d.Kill(containerName); err != nil {
-		return errors.WithMessagef(err, "failed to kill container %s", containerName)
+		return info, errors.WithMessagef(err, "failed to kill container %s", containerName)
+	}
+
+	if opts.Image == "" {
+		if err := d.buildImage(opts.Git); err != nil {
+			return info, err
+		}
+		opts.Image = d.imageTag
+	} else if _, _, err := d.client.ImageInspectWithRaw(d.ctx, opts.Image); err != nil {
+		return info, errors.WithMessagef(err, "image %s is not available", opts.Image)
+	} else {
+		fmt.Printf("reusing image %s\n", opts.Image)
+	}
+
+	var resp container.CreateResponse
+	err := d.withGPUs(opts.Accelerator, opts.GPUs, opts.GPUWait, func(gpus []int) error {
+		config, hostConfig, err := d.containerConfig(runCommand, runCommandArgs, opts, gpus)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("creating container %s\n", containerName)
+		if resp, err = d.client.ContainerCreate(d.ctx, config, hostConfig, nil, nil, containerName); err != nil {
+			return errors.WithMessagef(err, "failed to create container %s", containerName)
+		}
+
+		// started before the lock is let go, so the next launch sees the
+		// GPUs in use either way
+		fmt.Printf("starting container %s\n", containerName)
+		if err := d.client.ContainerStart(d.ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+			return errors.WithMessagef(err, "failed to start container %s", containerName)
+		}
+		return nil
+	})
+	if err != nil {
+		return info, err
 	}
 
+	fmt.Printf("started container %s\n", containerName)
+
+	return d.Inspect(resp.ID)
+}
+
+// buildImage builds the project into d.imageTag, labelled with its git state.
+func (d *DockerRun) buildImage(gitState *GitInfo) error {
 	buildCtx, err := archive.TarWithOptions(d.hostRootPath, &archive.TarOptions{})
 	if err != nil {
 		panic(err)
@@ -195,6 +289,12 @@ func (d *DockerRun) Run(
 		Remove:      true, // Remove intermediate containers after the build
 		ForceRemove: true, // Force removal of the image if it exists
 	}
+	if gitState != nil {
+		buildOptions.Labels = map[string]string{
+			labelGitCommit: gitState.Commit,
+			labelGitDirty:  fmt.Sprint(gitState.Dirty),
+		}
+	}
 
 	buildResponse, err := d.client.ImageBuild(d.ctx, buildCtx, buildOptions)
 	if err != nil {
@@ -208,89 +308,132 @@ func (d *DockerRun) Run(
 		return errors.WithMessagef(err, "failed to build image %s", d.imageTag)
 	}
 
+	return nil
+}
+
+// containerConfig assembles the container spec for the host profile and the
+// given accelerators, nil meaning all accelerators of the host.
+func (d *DockerRun) containerConfig(
+	runCommand string,
+	runCommandArgs []string,
+	opts RunOptions,
+	gpus []int,
+) (*container.Config, *container.HostConfig, error) {
+	profile, accelerator := opts.Profile, opts.Accelerator
+
 	// check if host has gpu
 	// if yes, add gpu to device requests
 	// else, don't add gpu to device requests
 	// this is a hacky way to get around the fact that docker doesn't support
 	// gpu passthrough on macos
-	dr := make([]container.DeviceRequest, 0, 1)
-	cos, _ := isCos()
-	dm := make([]container.DeviceMapping, 0, 1)
-	if _, err := os.Stat("/dev/nvidia0"); err == nil {
-		fmt.Printf("host has gpu, adding gpu to device requests\n")
-		if cos {
-			fmt.Printf("host is cos, not adding gpu to device requests\n")
-		} else {
-			dr = append(dr, container.DeviceRequest{
-				Count:        -1,
-				Capabilities: [][]string{{"gpu"}},
-			})
+	var devices deviceContribution
+	if d.endpoint.remote() {
+		// the device nodes of a remote host can not be looked at, its
+		// runtime hands out the gpus and the profile devices are passed as is
+		if accelerator.Name() != (noneProvider{}).Name() {
+			fmt.Printf("requesting %s devices from %s\n", accelerator.Name(), d.endpoint)
+			if gpus != nil {
+				fmt.Printf("using %s devices %s\n", accelerator.Name(), joinInts(gpus))
+			}
+			devices = accelerator.Contribute(d.devRoot, gpus, deviceAccess{Requests: true, Privileged: opts.Security.privileged()})
+			devices.Mappings = nil
 		}
-		// usually there's no need to add additional devices on bare-metal
-		// but with tcpx setup we need to add other nvidia-ish devices
-		dm = append(dm, createDeviceMapping(listNvidiaGPUs())...)
-		dm = append(dm, createDeviceMapping(listOtherNvidiaDevices())...)
+		devices.Mappings = append(devices.Mappings, createDeviceMapping(profile.Devices)...)
 	} else {
-		fmt.Printf("host does not have gpu, not adding gpu to device requests\n")
+		if len(accelerator.Indices(d.devRoot)) > 0 {
+			fmt.Printf("host has %s devices, adding them to the container\n", accelerator.Name())
+			if !profile.DeviceRequests {
+				fmt.Printf("host profile %s maps devices directly, not adding device requests\n", profile.Name)
+			}
+			if gpus != nil {
+				fmt.Printf("using %s devices %s\n", accelerator.Name(), joinInts(gpus))
+			}
+			devices = accelerator.Contribute(d.devRoot, gpus, deviceAccess{Requests: profile.DeviceRequests, Privileged: opts.Security.privileged()})
+		} else {
+			fmt.Printf("host does not have gpu, not adding gpu to device requests\n")
+		}
+		devices.Mappings = append(devices.Mappings, createDeviceMapping(existingPaths(d.devRoot, profile.Devices))...)
 	}
+	devices.Env = append(devices.Env, profile.Env...)
 
+	labels := map[string]string{labelInvoker: "true", labelGPUs: gpuLabelAll, labelSecurity: opts.Security.Mode}
+	if gpus != nil {
+		labels[labelGPUs] = joinInts(gpus)
+	}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+
+	projectDir := d.hostRootPath
+	if opts.ProjectDir != "" {
+		projectDir = opts.ProjectDir
+	}
+
+	// only the project directory of the cache is shared with both container
+	// users, see Layout
 	binds := []string{
-		fmt.Sprintf("%s:%s", d.hostRootPath, d.guestRootPath),
-		fmt.Sprintf("%s:%s", d.hostCachePath, d.guestCachePath),
-		fmt.Sprintf("%s:%s", d.hostCachePath, guestRootCachePath),
+		fmt.Sprintf("%s:%s", projectDir, d.guestRootPath),
+		fmt.Sprintf("%s:%s", d.hostProjectCachePath, d.guestProjectCachePath),
+		fmt.Sprintf("%s:%s", d.hostProjectCachePath, guestRootCachePath+guestCacheSubdir+d.projectName),
 	}
 
-	if _, err := os.Stat("/run/tcpx"); cos && err == nil {
-		fmt.Printf("host is cos, adding /run/tcpx to binds\n")
-		binds = append(binds, "/run/tcpx:/run/tcpx")
+	if opts.SharedCaches {
+		for _, subdir := range sharedCacheSubdirs {
+			// created here, docker would create a missing one owned by root
+			hostDir := filepath.Join(d.layout.CacheRoot(), subdir)
+			if err := os.MkdirAll(hostDir, 0o755); err != nil {
+				return nil, nil, errors.WithMessagef(err, "failed to create shared cache %s", hostDir)
+			}
+			binds = append(binds,
+				fmt.Sprintf("%s:%s", hostDir, guestCachePath+subdir),
+				fmt.Sprintf("%s:%s", hostDir, guestRootCachePath+subdir),
+			)
+		}
+	}
+
+	profileBinds := profile.Binds
+	if !d.endpoint.remote() {
+		profileBinds = profile.binds(d.devRoot)
+	}
+	binds = append(binds, profileBinds...)
+	devices.Env = append(devices.Env, profile.bindEnv(profileBinds)...)
+
+	resources := opts.Resources
+	if resources.NUMAPinned {
+		perRank, cpus, err := numaCPUSets(accelerator, d.devRoot, gpus)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("pinning the container to numa local cpus %s, local ranks to %s\n", cpus, strings.Join(perRank, " | "))
+		resources.CPUSet = cpus
+		devices.Env = append(devices.Env, rankCPUsEnv+"="+strings.Join(perRank, ";"))
 	}
 
-	fmt.Printf("creating container %s\n", containerName)
 	createOptions := types.ContainerCreateConfig{
-		Name: containerName,
 		Config: &container.Config{
-			Image:      d.imageTag,
+			Image:      opts.Image,
 			Entrypoint: append([]string{runCommand}, runCommandArgs...),
+			Env:        append(devices.Env, opts.Env...),
+			Labels:     labels,
 		},
 		HostConfig: &container.HostConfig{
 			Binds:       binds,
-			IpcMode:     container.IPCModeHost,
-			PidMode:     container.PidMode("host"),
+			Mounts:      opts.Mounts,
+			IpcMode:     resources.IPC,
+			ShmSize:     resources.ShmSize,
 			NetworkMode: container.NetworkMode("host"),
-			CapAdd:      []string{"NET_ADMIN"},
 			Resources: container.Resources{
-				DeviceRequests: dr,
-				Ulimits: []*units.Ulimit{
-					{
-						Name: "memlock",
-						Soft: -1,
-						Hard: -1,
-					},
-					{
-						Name: "stack",
-						Soft: 67108864,
-						Hard: 67108864,
-					},
-				},
-				Devices: dm,
+				DeviceRequests: devices.Requests,
+				Ulimits:        resources.Ulimits,
+				Memory:         resources.Memory,
+				CpusetCpus:     resources.CPUSet,
+				Devices:        devices.Mappings,
 			},
-			Privileged: true,
 		},
 	}
+	opts.Security.apply(createOptions.HostConfig, profile)
 
-	resp, err := d.client.ContainerCreate(d.ctx, createOptions.Config, createOptions.HostConfig, nil, nil, containerName)
-	if err != nil {
-		return errors.WithMessagef(err, "failed to create container %s", containerName)
-	}
-
-	fmt.Printf("starting container %s\n", containerName)
-	if err := d.client.ContainerStart(d.ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return errors.WithMessagef(err, "failed to start container %s", containerName)
-	}
-
-	fmt.Printf("started container %s\n", containerName)
-
-	return nil
+	return createOptions.Config, createOptions.HostConfig, nil
 }
 
 func PtrTo[T any](e T) *T {
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var dotenvKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// validateDotenv checks that content is a list of KEY=VALUE lines with
+// optional `export` prefixes, comments and quoted (possibly multiline) values.
+func validateDotenv(content []byte) error {
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return errors.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+
+		key = strings.TrimSpace(key)
+		if !dotenvKeyRegex.MatchString(key) {
+			return errors.Errorf("line %d: invalid key %q", i+1, key)
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			continue
+		}
+
+		// quoted values may span several lines until the closing quote
+		quote, start := value[0], i
+		rest := value[1:]
+		for !hasClosingQuote(rest, quote) {
+			i++
+			if i == len(lines) {
+				return errors.Errorf("line %d: unterminated quoted value for %s", start+1, key)
+			}
+			rest = lines[i]
+		}
+	}
+
+	return nil
+}
+
+func hasClosingQuote(s string, quote byte) bool {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++
+		case s[i] == quote:
+			return true
+		}
+	}
+
+	return false
+}
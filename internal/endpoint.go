@@ -0,0 +1,310 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultDockerSocket = "/var/run/docker.sock"
+
+	// probeImage is an empty image, its containers are only created to look
+	// at host paths through their mounts and never started
+	probeImage      = "invoker-probe:latest"
+	probeMountPoint = "/probe"
+)
+
+// DockerEndpoint is the docker daemon a DockerRun talks to.
+type DockerEndpoint struct {
+	// Host is tcp://host:port, ssh://[user@]host[:port][/socket] or
+	// unix:///path, empty for the local daemon of $DOCKER_HOST.
+	Host string
+	// TLSDir holds ca.pem, cert.pem and key.pem for tcp endpoints, it
+	// defaults to $DOCKER_CERT_PATH if $DOCKER_TLS_VERIFY is set.
+	TLSDir string
+	// SSH is used for ssh endpoints, user and port of the url win.
+	SSH SSHSpec
+}
+
+func (e DockerEndpoint) remote() bool {
+	return e.Host != ""
+}
+
+func (e DockerEndpoint) String() string {
+	if e.Host == "" {
+		return "the local docker daemon"
+	}
+
+	return e.Host
+}
+
+func (e DockerEndpoint) clientOptions() ([]client.Opt, error) {
+	opts := []client.Opt{client.WithAPIVersionNegotiation()}
+	if e.Host == "" {
+		return append(opts, client.FromEnv), nil
+	}
+
+	u, err := neturl.Parse(e.Host)
+	if err != nil || (u.Host == "" && u.Scheme != "unix") {
+		return nil, errors.Errorf("invalid docker endpoint %q", e.Host)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		return append(opts, client.WithHost(e.Host)), nil
+	case "tcp":
+		opts = append(opts, client.WithHost(e.Host))
+
+		tlsDir := e.TLSDir
+		if tlsDir == "" && os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			tlsDir = os.Getenv("DOCKER_CERT_PATH")
+		}
+		if tlsDir == "" {
+			fmt.Printf("warning: talking to %s without tls, anybody who can reach it controls the host\n", e.Host)
+			return opts, nil
+		}
+
+		return append(opts, client.WithTLSClientConfig(
+			filepath.Join(tlsDir, "ca.pem"),
+			filepath.Join(tlsDir, "cert.pem"),
+			filepath.Join(tlsDir, "key.pem"),
+		)), nil
+	case "ssh":
+		dialer, err := newSSHDockerDialer(u, e.SSH)
+		if err != nil {
+			return nil, err
+		}
+
+		// the host only names the daemon in requests, connections go through
+		// the ssh tunnel
+		return append(opts, client.WithHost("http://docker.invoker"), client.WithDialContext(dialer.dialContext)), nil
+	default:
+		return nil, errors.Errorf("unsupported docker endpoint %q, expected tcp://, ssh:// or unix://", e.Host)
+	}
+}
+
+// sshDockerDialer reaches the docker socket of a host through ssh, like the
+// docker cli does for ssh:// hosts but without needing it on either side.
+type sshDockerDialer struct {
+	transport *sshTransport
+	host      string
+	socket    string
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newSSHDockerDialer(u *neturl.URL, spec SSHSpec) (*sshDockerDialer, error) {
+	if u.User != nil {
+		spec.User = u.User.Username()
+	}
+	if port := u.Port(); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, errors.Errorf("invalid port in docker endpoint %q", u.String())
+		}
+		spec.Port = p
+	}
+
+	transport, err := newSSHTransport(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := u.Path
+	if socket == "" || socket == "/" {
+		socket = defaultDockerSocket
+	}
+
+	return &sshDockerDialer{transport: transport, host: u.Hostname(), socket: socket}, nil
+}
+
+func (d *sshDockerDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client == nil {
+		c, err := d.transport.dial(d.host)
+		if err != nil {
+			return nil, err
+		}
+		d.client = c
+	}
+
+	conn, err := d.client.Dial("unix", d.socket)
+	if err != nil {
+		// the connection may have dropped, the next request dials a new one
+		d.client.Close()
+		d.client = nil
+		return nil, errors.WithMessagef(err, "failed to reach %s on %s", d.socket, d.host)
+	}
+
+	return conn, nil
+}
+
+// DockerEndpoints gives every host a docker endpoint from a template.
+type DockerEndpoints struct {
+	// Template is e.g. ssh://{host} or tcp://{host}:2376, {host} stands for
+	// the host.
+	Template string
+	TLSDir   string
+	SSH      SSHSpec
+}
+
+func (e DockerEndpoints) forHost(host string) DockerEndpoint {
+	return DockerEndpoint{
+		Host:   strings.ReplaceAll(e.Template, "{host}", host),
+		TLSDir: e.TLSDir,
+		SSH:    e.SSH,
+	}
+}
+
+func (e DockerEndpoints) check(hosts []string) error {
+	if len(hosts) == 0 {
+		return errors.New("--hosts is required")
+	}
+	if len(hosts) > 1 && !strings.Contains(e.Template, "{host}") {
+		return errors.Errorf("docker endpoint %q would be the same for every host, use {host} in it, e.g. ssh://{host}", e.Template)
+	}
+
+	scheme, _, _ := strings.Cut(e.Template, "://")
+	if scheme != "tcp" && scheme != "ssh" && scheme != "unix" {
+		return errors.Errorf("unsupported docker endpoint %q, expected tcp://, ssh:// or unix://", e.Template)
+	}
+
+	return Validator().Struct(e.SSH)
+}
+
+// remoteAccelerator picks the accelerator of a host that is only known
+// through its docker daemon. Device nodes can not be looked at, so only
+// gpus handed out by the nvidia runtime are supported.
+func (d *DockerRun) remoteAccelerator(name string) (acceleratorProvider, error) {
+	switch name {
+	case "none":
+		return noneProvider{}, nil
+	case (nvidiaProvider{}).Name():
+		return nvidiaProvider{}, nil
+	case "", "auto":
+		info, err := d.client.Info(d.ctx)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to get info of %s", d.endpoint)
+		}
+		if _, ok := info.Runtimes["nvidia"]; ok {
+			return nvidiaProvider{}, nil
+		}
+		return noneProvider{}, nil
+	default:
+		return nil, errors.Errorf("%s devices have to be looked up on the host itself, run invoker there or use --ssh", name)
+	}
+}
+
+// ensureProbeImage imports probeImage into the daemon unless it is there.
+func (d *DockerRun) ensureProbeImage() error {
+	if _, _, err := d.client.ImageInspectWithRaw(d.ctx, probeImage); err == nil {
+		return nil
+	} else if !client.IsErrNotFound(err) {
+		return errors.WithMessagef(err, "failed to inspect image %s", probeImage)
+	}
+
+	var rootfs bytes.Buffer
+	tw := tar.NewWriter(&rootfs)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: strings.TrimPrefix(probeMountPoint, "/") + "/", Mode: 0o755}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	resp, err := d.client.ImageImport(d.ctx, types.ImageImportSource{Source: &rootfs, SourceName: "-"}, probeImage, types.ImageImportOptions{})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to import image %s", probeImage)
+	}
+	defer resp.Close()
+
+	_, err = io.Copy(io.Discard, resp)
+	return err
+}
+
+// sharedFileOwner checks that the host of the daemon has the file at path
+// with the given content, so that it shares the directory of the file with
+// this machine at the same path, and returns the owner of the file on the
+// host. Bind mounts do not create missing sources, a host without the
+// directory is refused.
+func (d *DockerRun) sharedFileOwner(path string, content []byte) (uid, gid int, err error) {
+	if err := d.ensureProbeImage(); err != nil {
+		return 0, 0, err
+	}
+
+	resp, err := d.client.ContainerCreate(d.ctx,
+		&container.Config{
+			Image:      probeImage,
+			Entrypoint: []string{probeMountPoint + "/none"},
+			Labels:     map[string]string{labelInvoker: "true"},
+		},
+		&container.HostConfig{
+			Mounts: []mount.Mount{{Type: mount.TypeBind, Source: filepath.Dir(path), Target: probeMountPoint, ReadOnly: true}},
+		},
+		nil, nil, "")
+	if err != nil {
+		return 0, 0, errors.WithMessagef(err, "%s is missing", filepath.Dir(path))
+	}
+	defer d.client.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+
+	archive, _, err := d.client.CopyFromContainer(d.ctx, resp.ID, probeMountPoint+"/"+filepath.Base(path))
+	if err != nil {
+		return 0, 0, errors.WithMessagef(err, "%s is missing", path)
+	}
+	defer archive.Close()
+
+	tr := tar.NewReader(archive)
+	header, err := tr.Next()
+	if err != nil {
+		return 0, 0, errors.WithMessagef(err, "failed to read %s", path)
+	}
+	got, err := io.ReadAll(io.LimitReader(tr, int64(len(content))+1))
+	if err != nil {
+		return 0, 0, errors.WithMessagef(err, "failed to read %s", path)
+	}
+	if !bytes.Equal(got, content) {
+		return 0, 0, errors.Errorf("%s differs from the one of this machine", path)
+	}
+
+	return header.Uid, header.Gid, nil
+}
+
+// checkSharedPaths makes sure the host of the daemon sees the project
+// directory and the cache of this machine at the same paths, e.g. over nfs:
+// its containers bind both and write checkpoints next to the run manifest
+// written here. The marker is a file of the run directory with content only
+// this launch knows. The container user gets the ids owning the cache on the
+// host.
+func (d *DockerRun) checkSharedPaths(projectDir, marker string, content []byte) error {
+	if _, _, err := d.sharedFileOwner(filepath.Join(projectDir, "hf.py"), []byte(runScript)); err != nil {
+		return errors.WithMessagef(err, "project directory %s is not shared with %s", projectDir, d.endpoint)
+	}
+
+	uid, gid, err := d.sharedFileOwner(marker, content)
+	if err != nil {
+		return errors.WithMessagef(err, "cache %s is not shared with %s", d.layout.CacheRoot(), d.endpoint)
+	}
+	d.hostUID, d.hostGID = uid, gid
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type FanOutArgs struct {
+	Run RunArgs
+	// Flags are the experiment run flags given to every host, without the
+	// run name, the port and the rank which are set for them.
+	Flags         []string
+	SSH           SSHSpec
+	RemoteInvoker string
+	// RemoteDir is the project directory on the hosts, the local one if
+	// empty.
+	RemoteDir string
+}
+
+// RunOverSSH launches the experiment on every host from this machine. Each
+// host runs experiment run with the same run name and its position in
+// --hosts as rank, instead of finding it out from its addresses.
+func RunOverSSH(args FanOutArgs) {
+	if err := Validator().Struct(args.SSH); err != nil {
+		panic(err)
+	}
+
+	if len(args.Run.Hosts) == 0 {
+		fmt.Println("--hosts is required")
+		os.Exit(1)
+	}
+
+	// decided here once, so the hosts need no nonce
+	runName := args.Run.RunName
+	if runName == "" {
+		layout, err := NewLayout(args.Run.CacheDir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// only the runs in the cache of this machine are seen, pass
+		// --run_name when the hosts keep runs this machine does not have
+		taken := runNameTaken(layout, args.Run.ProjectName, args.Run.ExperimentName)
+		if runName, err = generateRunName(args.Run.ExperimentName, args.Run.RunNameStyle, args.Run.RunNonce, false, taken); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printGeneratedRunName(runName)
+	}
+
+	// derived here as well, hosts with another --port_range default would
+	// not agree on it
+	port := args.Run.Port
+	if port == 0 {
+		r, err := ParsePortRange(args.Run.PortRange)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		port = hashedPort(r, args.Run.ProjectName, args.Run.ExperimentName, runName)
+		fmt.Printf("derived port %d from the run identity\n", port)
+	}
+
+	dir := args.RemoteDir
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("failed to get current working directory: %v\n", err)
+			os.Exit(1)
+		}
+		dir = cwd
+	}
+
+	transport, err := newSSHTransport(args.SSH)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("launching run %s on %d hosts from %s\n", runName, len(args.Run.Hosts), dir)
+	results := transport.fanOut(ctx, args.Run.Hosts, 0, func(rank int, host string) string {
+		argv := append([]string{args.RemoteInvoker, "experiment", "run"}, args.Flags...)
+		argv = append(argv, "--run_name", runName, "--port", fmt.Sprint(port), "--rank", fmt.Sprint(rank), "--")
+		argv = append(argv, args.Run.Rest...)
+
+		return shellCommand(dir, argv)
+	})
+
+	if !printHostResults(results) {
+		os.Exit(1)
+	}
+}
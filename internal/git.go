@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitInfo describes the state of the project tree a run was built from.
+type GitInfo struct {
+	Commit string `json:"commit"`
+	// Branch is empty for a detached HEAD.
+	Branch string `json:"branch,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Dirty  bool   `json:"dirty"`
+	// Untracked lists the files git does not know about and does not ignore,
+	// their content is part of the patch.
+	Untracked []string `json:"untracked,omitempty"`
+	// Patch is the path of the file holding the uncommitted changes.
+	Patch string `json:"patch,omitempty"`
+}
+
+func git(dir string, args ...string) (string, error) {
+	out, err := gitOutput(dir, nil, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// gitOutput runs git in dir, exit codes listed in ok are not treated as
+// failures.
+func gitOutput(dir string, ok []int, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if exitErr, isExit := err.(*exec.ExitError); isExit {
+		for _, code := range ok {
+			if exitErr.ExitCode() == code {
+				return out, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// gitInfo returns nil if dir is not inside a git work tree or git is not
+// installed, runs of such projects are simply not tied to a commit.
+func gitInfo(dir string) (*GitInfo, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, nil
+	}
+
+	if inside, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil || inside != "true" {
+		return nil, nil
+	}
+
+	commit, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	info := &GitInfo{Commit: commit}
+
+	if branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		info.Branch = branch
+	}
+
+	// not every clone has an origin, that is not an error
+	if remote, err := git(dir, "remote", "get-url", "origin"); err == nil {
+		info.Remote = remote
+	}
+
+	// only the project directory ends up in the image, hf.py is written there
+	// by every run and does not count as a change
+	status, err := git(dir, "status", "--porcelain", "--", ".", ":(exclude)hf.py")
+	if err != nil {
+		return nil, err
+	}
+	info.Dirty = status != ""
+
+	untracked, err := git(dir, "ls-files", "--others", "--exclude-standard", "--", ".", ":(exclude)hf.py")
+	if err != nil {
+		return nil, err
+	}
+	if untracked != "" {
+		info.Untracked = strings.Split(untracked, "\n")
+	}
+
+	return info, nil
+}
+
+// gitPatch returns the uncommitted changes below dir, including the untracked
+// files, in a form git apply understands when run from dir.
+func gitPatch(dir string, info *GitInfo) ([]byte, error) {
+	patch, err := gitOutput(dir, nil, "diff", "--binary", "--relative", "HEAD", "--", ".", ":(exclude)hf.py")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range info.Untracked {
+		// --no-index exits with 1 when the files differ, which they always do
+		diff, err := gitOutput(dir, []int{1}, "diff", "--binary", "--no-index", "--", "/dev/null", file)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, diff...)
+	}
+
+	return patch, nil
+}
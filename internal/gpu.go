@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+)
+
+type gpuRequest struct {
+	// Indices are explicitly selected GPUs, nil means all of them.
+	Indices []int
+	// Auto is the number of free GPUs to allocate, set by auto:N.
+	Auto int
+}
+
+// count returns how many GPUs the request assigns, or -1 for all of them.
+func (r gpuRequest) count() int {
+	switch {
+	case r.Auto > 0:
+		return r.Auto
+	case r.Indices != nil:
+		return len(r.Indices)
+	default:
+		return -1
+	}
+}
+
+// parseGPUs parses a --gpus value like "0,1,2,3" or "auto:4". An empty value
+// means all GPUs of the host.
+func parseGPUs(spec string) (gpuRequest, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "all" {
+		return gpuRequest{}, nil
+	}
+
+	if n, found := strings.CutPrefix(spec, "auto:"); found {
+		auto, err := strconv.Atoi(n)
+		if err != nil || auto < 1 {
+			return gpuRequest{}, errors.Errorf("invalid gpu count in %q", spec)
+		}
+		return gpuRequest{Auto: auto}, nil
+	}
+
+	indices, err := parseIndices(spec)
+	if err != nil {
+		return gpuRequest{}, errors.WithMessagef(err, "invalid gpu indices %q", spec)
+	}
+
+	seen := make(map[int]bool)
+	gpus := make([]int, 0, len(indices))
+	for _, index := range indices {
+		if index < 0 {
+			return gpuRequest{}, errors.Errorf("invalid gpu index %d in %q", index, spec)
+		}
+
+		if !seen[index] {
+			seen[index] = true
+			gpus = append(gpus, index)
+		}
+	}
+	sort.Ints(gpus)
+
+	return gpuRequest{Indices: gpus}, nil
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(v))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+const gpuPollInterval = 15 * time.Second
+
+type notEnoughGPUsError struct {
+	wanted int
+	free   []int
+}
+
+func (e *notEnoughGPUsError) Error() string {
+	return fmt.Sprintf("%d gpus requested but only %d are free (%s)", e.wanted, len(e.free), joinInts(e.free))
+}
+
+// claimedGPUs maps the GPU indices used by invoker containers to the
+// container that holds them, based on the gpus label. Containers that are
+// created but not started yet count, they are about to use their GPUs.
+func (d *DockerRun) claimedGPUs(accelerator acceleratorProvider) (map[int]string, error) {
+	options := types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", labelInvoker),
+			filters.Arg("status", "created"),
+			filters.Arg("status", "running"),
+			filters.Arg("status", "restarting"),
+		),
+	}
+
+	containers, err := d.client.ContainerList(d.ctx, options)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list invoker containers")
+	}
+
+	claimed := make(map[int]string)
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		value, ok := c.Labels[labelGPUs]
+		if !ok || value == "" {
+			continue
+		}
+
+		indices := accelerator.Indices(d.devRoot)
+		if value != gpuLabelAll {
+			if indices, err = parseIndices(value); err != nil {
+				return nil, errors.WithMessagef(err, "bad %s label on container %s", labelGPUs, name)
+			}
+		}
+
+		for _, index := range indices {
+			claimed[index] = name
+		}
+	}
+
+	return claimed, nil
+}
+
+// pickGPUs resolves the request against the GPUs claimed by other
+// invoker containers. It must be called with the gpu lock held.
+func (d *DockerRun) pickGPUs(accelerator acceleratorProvider, request gpuRequest) ([]int, error) {
+	claimed, err := d.claimedGPUs(accelerator)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Auto == 0 {
+		for _, index := range request.Indices {
+			if holder, ok := claimed[index]; ok {
+				fmt.Printf("warning: gpu %d is also used by container %s\n", index, holder)
+			}
+		}
+		return request.Indices, nil
+	}
+
+	free := make([]int, 0, maxAccelerators)
+	for _, index := range accelerator.Indices(d.devRoot) {
+		if _, ok := claimed[index]; !ok {
+			free = append(free, index)
+		}
+	}
+
+	if len(free) < request.Auto {
+		return nil, &notEnoughGPUsError{wanted: request.Auto, free: free}
+	}
+
+	return free[:request.Auto], nil
+}
+
+// withGPUs picks GPUs for the request and calls create with them while
+// holding the host-wide gpu lock, so the container that claims them exists
+// before anybody else looks. If not enough GPUs are free it retries until
+// wait runs out.
+func (d *DockerRun) withGPUs(accelerator acceleratorProvider, request gpuRequest, wait time.Duration, create func(gpus []int) error) error {
+	lockPath := filepath.Join(d.layout.StateDir(), "gpus.lock")
+
+	deadline := time.Now().Add(wait)
+	for {
+		var short *notEnoughGPUsError
+		err := withFileLock(lockPath, func() error {
+			gpus, err := d.pickGPUs(accelerator, request)
+			if errors.As(err, &short) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			return create(gpus)
+		})
+
+		if err != nil || short == nil {
+			return err
+		}
+
+		if !time.Now().Add(gpuPollInterval).Before(deadline) {
+			return short
+		}
+
+		fmt.Printf("%v, waiting for gpus to be released\n", short)
+		time.Sleep(gpuPollInterval)
+	}
+}
+
+func parseIndices(value string) ([]int, error) {
+	indices := make([]int, 0, maxAccelerators)
+	for _, part := range strings.Split(value, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, index)
+	}
+
+	return indices, nil
+}
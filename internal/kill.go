@@ -2,7 +2,11 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type KillArgs struct {
@@ -10,10 +14,14 @@ type KillArgs struct {
 	Hosts          []string `validate:"required,min=1"`
 	ExperimentName string   `validate:"varname"`
 	ContainerName  *string
+	// Rank skips finding this host in Hosts by its addresses, which leaves
+	// hosts that are not found alone.
+	Rank     *int
+	CacheDir string
 }
 
 func nameFromKillArgs(args KillArgs) string {
-  if args.ContainerName != nil && *args.ContainerName != "" {
+	if args.ContainerName != nil && *args.ContainerName != "" {
 		return *args.ContainerName
 	}
 
@@ -25,25 +33,146 @@ func Kill(args KillArgs) {
 		panic(err)
 	}
 
-	rankAndMasterElseExit(args.Hosts)
+	if args.Rank == nil {
+		rankAndMasterElseExit(args.Hosts)
+	} else if *args.Rank < 0 || *args.Rank >= len(args.Hosts) {
+		fmt.Printf("--rank=%d but there are %d hosts\n", *args.Rank, len(args.Hosts))
+		os.Exit(1)
+	}
 
-	// get home directory
-	home, err := os.UserHomeDir()
+	layout, err := NewLayout(args.CacheDir)
 	if err != nil {
 		panic(err)
 	}
 
-	cachePath := home + "/.cache/" + args.ProjectName + "/" + "experiments/"
-
 	// get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 
-	dr := NewDockerRun(context.Background(), args.ProjectName, cwd, cachePath)
+	dr, err := NewDockerRun(context.Background(), args.ProjectName, cwd, layout, DockerEndpoint{})
+	if err != nil {
+		panic(err)
+	}
+
+	// reported per host by --all_hosts, so no stack traces
+	containerName := nameFromKillArgs(args)
+	removed, err := dr.KillRuns(containerName)
+	// the leases of the containers that are gone are released either way
+	leases := newPortLeases(layout)
+	for _, name := range append(removed, containerName) {
+		if err := leases.release(name); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+type KillAllHostsArgs struct {
+	Kill KillArgs
+	// Flags are the experiment kill flags given to every host, without the
+	// rank which is set for them.
+	Flags         []string
+	SSH           SSHSpec
+	RemoteInvoker string
+	// Timeout is the number of seconds a host gets, 0 waits as long as it
+	// takes.
+	Timeout int `validate:"min=0"`
+}
 
-	if err := dr.Kill(nameFromKillArgs(args)); err != nil {
+// KillAllHosts kills the experiment on every host at once over ssh and
+// fails if it failed on any of them.
+func KillAllHosts(args KillAllHostsArgs) {
+	if err := Validator().Struct(args.Kill); err != nil {
+		panic(err)
+	}
+	if err := Validator().Struct(args.SSH); err != nil {
 		panic(err)
 	}
+
+	transport, err := newSSHTransport(args.SSH)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	timeout := time.Duration(args.Timeout) * time.Second
+	fmt.Printf("killing %s on %d hosts\n", nameFromKillArgs(args.Kill), len(args.Kill.Hosts))
+	results := transport.fanOut(context.Background(), args.Kill.Hosts, timeout, func(rank int, host string) string {
+		argv := append([]string{args.RemoteInvoker, "experiment", "kill"}, args.Flags...)
+		argv = append(argv, "--rank", fmt.Sprint(rank))
+
+		return shellCommand("", argv)
+	})
+
+	if !printHostResults(results) {
+		os.Exit(1)
+	}
+}
+
+type EndpointKillArgs struct {
+	Kill      KillArgs
+	Endpoints DockerEndpoints
+	// Timeout is the number of seconds a host gets, 0 waits as long as it
+	// takes.
+	Timeout int `validate:"min=0"`
+}
+
+// KillOnEndpoints kills the experiment on every host through its docker
+// daemon and fails if it failed on any of them.
+func KillOnEndpoints(args EndpointKillArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+	if err := args.Endpoints.check(args.Kill.Hosts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	layout, err := NewLayout(args.Kill.CacheDir)
+	if err != nil {
+		panic(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	containerName := nameFromKillArgs(args.Kill)
+	timeout := time.Duration(args.Timeout) * time.Second
+	fmt.Printf("killing %s on %d hosts\n", containerName, len(args.Kill.Hosts))
+
+	results := make([]hostResult, 0, len(args.Kill.Hosts))
+	for rank, host := range args.Kill.Hosts {
+		endpoint := args.Endpoints.forHost(host)
+		fmt.Printf("\n%s through %s\n", host, endpoint)
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		start := time.Now()
+		dr, err := NewDockerRun(ctx, args.Kill.ProjectName, cwd, layout, endpoint)
+		if err == nil {
+			_, err = dr.KillRuns(containerName)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errors.Errorf("timed out after %s", timeout)
+		}
+		cancel()
+
+		results = append(results, hostResult{Host: host, Rank: rank, Err: err, Elapsed: time.Since(start)})
+	}
+
+	fmt.Println()
+	if !printHostResults(results) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const runManifestName = "run.json"
+
+const (
+	// stateDirEnv overrides the state dir, e.g. for tests.
+	stateDirEnv = "INVOKER_STATE_DIR"
+	// systemStateDir is shared by the users of docker on the host. Only root
+	// can create it, the others fall back to a state dir of their own.
+	systemStateDir = "/var/lib/invoker"
+)
+
+// Layout is the single place that knows where invoker keeps things on the
+// host. Every command resolves its paths through it:
+//
+//	<state dir>/                       $INVOKER_STATE_DIR, /var/lib/invoker or
+//	                                   ~/.local/state/invoker
+//	  ports.json, ports.lock           port leases
+//	  gpus.lock                        gpu allocation lock
+//	  queue.json, queue.lock           run queue, see queue worker
+//
+//	<cache root>/                      --cache_dir, $XDG_CACHE_HOME or ~/.cache
+//	  higgsfield/
+//	    uploads.json                   unfinished multipart uploads of run push
+//	    <project>/
+//	      experiments/
+//	        <experiment>/
+//	          .sweeps/<sweep>.json     sweep manifests, see SweepManifest
+//	          <run>/                   checkpoints, written by the training code
+//	            run.json               run manifest, see RunManifest
+//	            .invoker/              run metadata written by invoker
+//	              git.patch            uncommitted changes of the project
+//	              tags                 run tags, tagged runs survive run prune
+//	              hashes.json          file hashes cached by run push and pull
+//	              logs/                container logs
+//
+// The state dir belongs to the host, not to a user or a cache root, since
+// ports, gpus and the queue are shared by everybody launching there. It is
+// only shared through /var/lib/invoker, which root creates for the docker
+// group, see makeStateDir.
+//
+// The project directory is mounted at the same place below ~/.cache of both
+// container users, so the training code finds the run directory relative to
+// its home as invoker does on the host. So are the sharedCacheSubdirs, unless
+// the run isolates its caches. The rest of the cache root stays private.
+type Layout struct {
+	cacheRoot string
+	stateDir  string
+}
+
+// NewLayout roots the layout at cacheDir if given, otherwise at
+// $XDG_CACHE_HOME or ~/.cache.
+func NewLayout(cacheDir string) (*Layout, error) {
+	if cacheDir == "" {
+		cacheDir = os.Getenv("XDG_CACHE_HOME")
+	}
+
+	if cacheDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to get user home directory")
+		}
+		cacheDir = filepath.Join(home, ".cache")
+	}
+
+	cacheDir, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to resolve cache directory %s", cacheDir)
+	}
+
+	stateDir := os.Getenv(stateDirEnv)
+	if stateDir == "" {
+		if stateDir, err = defaultStateDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	stateDir, err = filepath.Abs(stateDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to resolve state directory %s", stateDir)
+	}
+
+	return &Layout{cacheRoot: cacheDir, stateDir: stateDir}, nil
+}
+
+// defaultStateDir is the system state dir if it exists or can be created,
+// otherwise $XDG_STATE_HOME/invoker or ~/.local/state/invoker.
+func defaultStateDir() (string, error) {
+	if _, err := os.Lstat(systemStateDir); err == nil || os.Geteuid() == 0 {
+		return systemStateDir, nil
+	}
+
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, "invoker"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to get user home directory")
+	}
+
+	return filepath.Join(home, ".local", "state", "invoker"), nil
+}
+
+func (l *Layout) CacheRoot() string {
+	return l.cacheRoot
+}
+
+func (l *Layout) HiggsfieldDir() string {
+	return filepath.Join(l.cacheRoot, "higgsfield")
+}
+
+// StateDir holds the host-wide locks and registries, see Layout.
+func (l *Layout) StateDir() string {
+	return l.stateDir
+}
+
+func (l *Layout) ProjectDir(projectName string) string {
+	return filepath.Join(l.HiggsfieldDir(), projectName)
+}
+
+func (l *Layout) ExperimentsDir(projectName string) string {
+	return filepath.Join(l.ProjectDir(projectName), "experiments")
+}
+
+func (l *Layout) ExperimentDir(projectName, experimentName string) string {
+	return filepath.Join(l.ExperimentsDir(projectName), experimentName)
+}
+
+func (l *Layout) RunDir(projectName, experimentName, runName string) string {
+	return filepath.Join(l.ExperimentDir(projectName, experimentName), runName)
+}
+
+// UploadsPath remembers unfinished multipart uploads of run push, it is kept
+// outside of the runs so that pushing does not change them.
+func (l *Layout) UploadsPath() string {
+	return filepath.Join(l.HiggsfieldDir(), "uploads.json")
+}
+
+// SweepManifestPath tracks the points of an experiment sweep.
+func (l *Layout) SweepManifestPath(projectName, experimentName, sweepName string) string {
+	return filepath.Join(l.ExperimentDir(projectName, experimentName), ".sweeps", sweepName+".json")
+}
+
+func (l *Layout) RunManifestPath(projectName, experimentName, runName string) string {
+	return filepath.Join(l.RunDir(projectName, experimentName, runName), runManifestName)
+}
+
+// RunMetadataDir keeps invoker's own files apart from the checkpoints.
+func (l *Layout) RunMetadataDir(projectName, experimentName, runName string) string {
+	return filepath.Join(l.RunDir(projectName, experimentName, runName), ".invoker")
+}
+
+// RunTagsPath holds the tags of a run, one per line.
+func (l *Layout) RunTagsPath(projectName, experimentName, runName string) string {
+	return filepath.Join(l.RunMetadataDir(projectName, experimentName, runName), "tags")
+}
+
+// RunHashCachePath remembers file hashes between pushes of a run.
+func (l *Layout) RunHashCachePath(projectName, experimentName, runName string) string {
+	return filepath.Join(l.RunMetadataDir(projectName, experimentName, runName), "hashes.json")
+}
+
+func (l *Layout) RunLogsDir(projectName, experimentName, runName string) string {
+	return filepath.Join(l.RunMetadataDir(projectName, experimentName, runName), "logs")
+}
+
+// MakeRunDirs creates the cache root and the run directory with its
+// metadata and log directories.
+func (l *Layout) MakeRunDirs(projectName, experimentName, runName string) error {
+	cacheDir := Path{path: l.cacheRoot}
+	if err := cacheDir.mkdirIfNotExists(); err != nil {
+		return errors.WithMessage(err, "failed to create cache directory")
+	}
+
+	logsDir := Path{path: l.RunLogsDir(projectName, experimentName, runName)}
+	if err := logsDir.mkdirIfNotExists(); err != nil {
+		return errors.WithMessagef(err, "failed to create checkpoint directory for experiment %s and run name %s", experimentName, runName)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLeaseTTL bounds how long a lease that is not yet backed by a running
+// container is kept, e.g. while the image for the run is still being built.
+const defaultLeaseTTL = time.Hour
+
+type portLease struct {
+	Port      int       `json:"port"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is zero once the owner container has started, the lease is
+	// then held until that container is gone.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (l portLease) expired(now time.Time, running map[string]bool) bool {
+	if !l.ExpiresAt.IsZero() {
+		return now.After(l.ExpiresAt)
+	}
+
+	// if docker could not be queried, keep the lease to stay on the safe side
+	return running != nil && !running[l.Owner]
+}
+
+type portLeases struct {
+	path     string
+	lockPath string
+}
+
+func newPortLeases(layout *Layout) *portLeases {
+	return &portLeases{
+		path:     filepath.Join(layout.StateDir(), "ports.json"),
+		lockPath: filepath.Join(layout.StateDir(), "ports.lock"),
+	}
+}
+
+func (p *portLeases) load() ([]portLease, error) {
+	content, err := readStateFile(p.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", p.path)
+	}
+
+	var leases []portLease
+	if err := json.Unmarshal(content, &leases); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse %s", p.path)
+	}
+
+	return leases, nil
+}
+
+func (p *portLeases) save(leases []portLease) error {
+	content, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode port leases")
+	}
+
+	return writeFileAtomic(p.path, content, 0o644, true)
+}
+
+// update loads the live leases under the lock, hands them to fn and stores
+// whatever fn returns.
+func (p *portLeases) update(fn func(leases []portLease) ([]portLease, error)) error {
+	running, err := runningContainerNames(context.Background())
+	if err != nil {
+		running = nil
+	}
+
+	return withFileLock(p.lockPath, func() error {
+		leases, err := p.load()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		live := make([]portLease, 0, len(leases))
+		for _, l := range leases {
+			if !l.expired(now, running) {
+				live = append(live, l)
+			}
+		}
+
+		updated, err := fn(live)
+		if err != nil {
+			return err
+		}
+
+		return p.save(updated)
+	})
+}
+
+func takenPorts(leases []portLease) map[int]string {
+	taken := make(map[int]string, len(leases))
+	for _, l := range leases {
+		taken[l.Port] = l.Owner
+	}
+
+	return taken
+}
+
+// reserve picks a port with pick and leases it to owner, replacing any lease
+// owner already has. A zero ttl holds the lease until the owner container
+// exits.
+func (p *portLeases) reserve(owner string, ttl time.Duration, pick func(taken map[int]string) (int, error)) (int, error) {
+	var port int
+	err := p.update(func(leases []portLease) ([]portLease, error) {
+		kept := make([]portLease, 0, len(leases)+1)
+		for _, l := range leases {
+			if owner == "" || l.Owner != owner {
+				kept = append(kept, l)
+			}
+		}
+
+		var err error
+		if port, err = pick(takenPorts(kept)); err != nil {
+			return nil, err
+		}
+
+		lease := portLease{Port: port, Owner: owner, CreatedAt: time.Now()}
+		if ttl > 0 {
+			lease.ExpiresAt = lease.CreatedAt.Add(ttl)
+		}
+
+		return append(kept, lease), nil
+	})
+
+	return port, err
+}
+
+// reservePort leases a specific port to owner and fails if somebody else
+// holds it.
+func (p *portLeases) reservePort(port int, owner string, ttl time.Duration) error {
+	_, err := p.reserve(owner, ttl, func(taken map[int]string) (int, error) {
+		if holder, ok := taken[port]; ok {
+			if holder == "" {
+				holder = "an anonymous reservation"
+			}
+			return 0, errors.Errorf("port %d is reserved by %s", port, holder)
+		}
+		return port, nil
+	})
+
+	return err
+}
+
+// hold turns the lease of owner into one that lasts as long as its container.
+func (p *portLeases) hold(owner string) error {
+	return p.update(func(leases []portLease) ([]portLease, error) {
+		for i := range leases {
+			if leases[i].Owner == owner {
+				leases[i].ExpiresAt = time.Time{}
+			}
+		}
+		return leases, nil
+	})
+}
+
+func (p *portLeases) release(owner string) error {
+	return p.update(func(leases []portLease) ([]portLease, error) {
+		kept := make([]portLease, 0, len(leases))
+		for _, l := range leases {
+			if l.Owner != owner {
+				kept = append(kept, l)
+			} else {
+				fmt.Printf("releasing port %d held by %s\n", l.Port, owner)
+			}
+		}
+		return kept, nil
+	})
+}
+
+func (p *portLeases) taken() (map[int]string, error) {
+	var taken map[int]string
+	err := p.update(func(leases []portLease) ([]portLease, error) {
+		taken = takenPorts(leases)
+		return leases, nil
+	})
+
+	return taken, err
+}
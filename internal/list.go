@@ -0,0 +1,435 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// runStatusUnknown is reported for run directories without a manifest, e.g.
+// ones created before manifests were written.
+const runStatusUnknown = "unknown"
+
+type runEntry struct {
+	Project     string    `json:"project"`
+	Experiment  string    `json:"experiment"`
+	Run         string    `json:"run"`
+	Path        string    `json:"path"`
+	Status      string    `json:"status"`
+	Checkpoints int       `json:"checkpoints"`
+	Size        int64     `json:"size"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	Tags        []string  `json:"tags,omitempty"`
+	// Manifest is nil for runs without a run.json.
+	Manifest *RunManifest `json:"manifest,omitempty"`
+}
+
+type experimentEntry struct {
+	Project    string    `json:"project"`
+	Experiment string    `json:"experiment"`
+	Path       string    `json:"path"`
+	Runs       int       `json:"runs"`
+	Running    int       `json:"running"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type runFilter struct {
+	ProjectName    string
+	ExperimentName string
+	Status         string
+}
+
+func (f runFilter) matches(e runEntry) bool {
+	return (f.ProjectName == "" || e.Project == f.ProjectName) &&
+		(f.ExperimentName == "" || e.Experiment == f.ExperimentName) &&
+		(f.Status == "" || e.Status == f.Status)
+}
+
+// subdirs lists the directories in dir that are not hidden, a missing dir
+// has none.
+func subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", dir)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// checkpoint is a top level entry of a run directory written by the training
+// code, anything invoker put there itself is left out.
+type checkpoint struct {
+	Path       string
+	ModifiedAt time.Time
+}
+
+// runCheckpoints lists the checkpoints of a run, oldest first.
+func runCheckpoints(runDir string) ([]checkpoint, error) {
+	entries, err := os.ReadDir(runDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", runDir)
+	}
+
+	var checkpoints []checkpoint
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.Name() == runManifestName {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to stat %s", entry.Name())
+		}
+		checkpoints = append(checkpoints, checkpoint{
+			Path:       filepath.Join(runDir, entry.Name()),
+			ModifiedAt: info.ModTime(),
+		})
+	}
+
+	sort.SliceStable(checkpoints, func(i, j int) bool {
+		return checkpoints[i].ModifiedAt.Before(checkpoints[j].ModifiedAt)
+	})
+
+	return checkpoints, nil
+}
+
+// dirUsage sums up the size of all files below dir and finds the latest
+// modification.
+func dirUsage(dir string) (int64, time.Time, error) {
+	var size int64
+	var modifiedAt time.Time
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modifiedAt) {
+			modifiedAt = info.ModTime()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, modifiedAt, errors.WithMessagef(err, "failed to walk %s", dir)
+	}
+
+	return size, modifiedAt, nil
+}
+
+func runKey(project, experiment, run string) string {
+	return project + "/" + experiment + "/" + run
+}
+
+// runContainers is what the local docker daemon knows about the runs.
+type runContainers struct {
+	// running holds the runs that have a running container, by runKey.
+	running map[string]bool
+	// stopped holds the state of the invoker containers that exited but were
+	// not removed yet, by container ID.
+	stopped map[string]*types.ContainerState
+}
+
+// reconcile records the end of a run whose container exited on its own.
+// Nothing waits for containers, so run.json still says running until a
+// command that reads it finds the container stopped. The manifest is saved
+// to path if it changed.
+func (c *runContainers) reconcile(path string, manifest *RunManifest) {
+	if manifest.Status != runStatusRunning || manifest.FinishedAt != nil {
+		return
+	}
+
+	state, ok := c.stopped[manifest.ContainerID]
+	if !ok {
+		return
+	}
+
+	manifest.finished(state, false)
+	if err := manifest.save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record the end of the run: %v\n", err)
+	}
+}
+
+// runningRuns asks the local docker daemon about the containers of the runs.
+func runningRuns(ctx context.Context) (*runContainers, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create docker client")
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelInvoker)),
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list containers")
+	}
+
+	runs := &runContainers{
+		running: make(map[string]bool, len(containers)),
+		stopped: make(map[string]*types.ContainerState),
+	}
+	for _, c := range containers {
+		switch c.State {
+		case "running", "restarting", "paused":
+			runs.running[runKey(c.Labels[labelProject], c.Labels[labelExperiment], c.Labels[labelRun])] = true
+		case "exited", "dead":
+			// the list has no exit code
+			info, err := cli.ContainerInspect(ctx, c.ID)
+			if err != nil {
+				continue
+			}
+			runs.stopped[c.ID] = info.State
+		}
+	}
+
+	return runs, nil
+}
+
+// scanRuns walks the layout and collects every run matching filter. containers
+// may be nil if docker could not be asked, the manifests are trusted then.
+func scanRuns(layout *Layout, filter runFilter, containers *runContainers) ([]runEntry, error) {
+	projects, err := subdirs(layout.HiggsfieldDir())
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []runEntry{}
+	for _, project := range projects {
+		if filter.ProjectName != "" && project != filter.ProjectName {
+			continue
+		}
+
+		experiments, err := subdirs(layout.ExperimentsDir(project))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, experiment := range experiments {
+			if filter.ExperimentName != "" && experiment != filter.ExperimentName {
+				continue
+			}
+
+			names, err := subdirs(layout.ExperimentDir(project, experiment))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, name := range names {
+				entry, err := readRunEntry(layout, project, experiment, name, containers)
+				if err != nil {
+					return nil, err
+				}
+
+				if filter.matches(entry) {
+					runs = append(runs, entry)
+				}
+			}
+		}
+	}
+
+	return runs, nil
+}
+
+func readRunEntry(layout *Layout, project, experiment, run string, containers *runContainers) (runEntry, error) {
+	entry := runEntry{
+		Project:    project,
+		Experiment: experiment,
+		Run:        run,
+		Path:       layout.RunDir(project, experiment, run),
+		Status:     runStatusUnknown,
+	}
+
+	var err error
+	if entry.Size, entry.ModifiedAt, err = dirUsage(entry.Path); err != nil {
+		return entry, err
+	}
+
+	checkpoints, err := runCheckpoints(entry.Path)
+	if err != nil {
+		return entry, err
+	}
+	entry.Checkpoints = len(checkpoints)
+
+	if entry.Tags, err = runTags(layout, project, experiment, run); err != nil {
+		return entry, err
+	}
+
+	manifestPath := layout.RunManifestPath(project, experiment, run)
+	manifest, err := loadRunManifest(manifestPath)
+	if err == nil {
+		if containers != nil {
+			containers.reconcile(manifestPath, manifest)
+		}
+		entry.Manifest = manifest
+		entry.Status = manifest.Status
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	if containers != nil {
+		isRunning := containers.running[runKey(project, experiment, run)]
+		if isRunning {
+			entry.Status = runStatusRunning
+		} else if entry.Status == runStatusRunning {
+			// the container went away without invoker noticing
+			entry.Status = runStatusExited
+		}
+	}
+
+	return entry, nil
+}
+
+type ListArgs struct {
+	ProjectName    string `validate:"omitempty,varname"`
+	ExperimentName string `validate:"omitempty,varname"`
+	Status         string `validate:"omitempty,oneof=running completed failed killed exited unknown"`
+	JSON           bool
+	CacheDir       string
+}
+
+func listRuns(args ListArgs) []runEntry {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	containers, err := runningRuns(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v, the status is taken from the run manifests\n", err)
+		containers = nil
+	}
+
+	runs, err := scanRuns(layout, runFilter{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		Status:         args.Status,
+	}, containers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return runs
+}
+
+func ListRuns(args ListArgs) {
+	runs := listRuns(args)
+
+	if args.JSON {
+		printJSON(runs)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "PROJECT\tEXPERIMENT\tRUN\tSTATUS\tCHECKPOINTS\tSIZE\tMODIFIED\tTAGS\n")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			r.Project, r.Experiment, r.Run, r.Status, r.Checkpoints, units.BytesSize(float64(r.Size)), formatModified(r.ModifiedAt), valueOr(strings.Join(r.Tags, ","), "-"))
+	}
+}
+
+// ListExperiments aggregates the runs per experiment, the status filter
+// selects the runs that are counted.
+func ListExperiments(args ListArgs) {
+	runs := listRuns(args)
+
+	experiments := []experimentEntry{}
+	index := map[string]int{}
+	for _, r := range runs {
+		key := r.Project + "/" + r.Experiment
+		i, ok := index[key]
+		if !ok {
+			i = len(experiments)
+			index[key] = i
+			experiments = append(experiments, experimentEntry{
+				Project:    r.Project,
+				Experiment: r.Experiment,
+				Path:       filepath.Dir(r.Path),
+			})
+		}
+
+		e := &experiments[i]
+		e.Runs++
+		e.Size += r.Size
+		if r.Status == runStatusRunning {
+			e.Running++
+		}
+		if r.ModifiedAt.After(e.ModifiedAt) {
+			e.ModifiedAt = r.ModifiedAt
+		}
+	}
+
+	if args.JSON {
+		printJSON(experiments)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "PROJECT\tEXPERIMENT\tRUNS\tRUNNING\tSIZE\tMODIFIED\n")
+	for _, e := range experiments {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n",
+			e.Project, e.Experiment, e.Runs, e.Running, units.BytesSize(float64(e.Size)), formatModified(e.ModifiedAt))
+	}
+}
+
+func formatModified(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func printJSON(v any) {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(string(content))
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// makeStateDir creates the host state dir if it is missing and checks that it
+// can be trusted. The system one is shared by root and the docker group,
+// whose members control the host through docker anyway; a per-user one is
+// private.
+func makeStateDir(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return errors.WithMessagef(err, "failed to create directory %s", filepath.Dir(dir))
+	}
+
+	if err := os.Mkdir(dir, 0o700); err == nil && dir == systemStateDir {
+		if group, err := user.LookupGroup("docker"); err == nil {
+			if gid, err := strconv.Atoi(group.Gid); err == nil {
+				os.Chown(dir, -1, gid)
+			}
+		}
+		if err := os.Chmod(dir, 0o770); err != nil {
+			return errors.WithMessagef(err, "failed to share %s with the docker group", dir)
+		}
+	} else if err != nil && !os.IsExist(err) {
+		return errors.WithMessagef(err, "failed to create directory %s", dir)
+	}
+
+	_, err := checkStateDir(dir)
+	return err
+}
+
+// checkStateDir refuses a state dir that others could have put there or can
+// swap files in. restricted tells whether only root and its group can write
+// to it, so that files of other users in it can be trusted as well.
+func checkStateDir(dir string) (restricted bool, err error) {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return false, errors.WithMessagef(err, "failed to stat %s", dir)
+	}
+	if !info.IsDir() {
+		return false, errors.Errorf("state dir %s is not a directory", dir)
+	}
+
+	owner, err := fileOwner(dir, info)
+	if err != nil {
+		return false, err
+	}
+
+	worldWritable := info.Mode().Perm()&0o002 != 0
+	if worldWritable && info.Mode()&os.ModeSticky == 0 {
+		return false, errors.Errorf("state dir %s is writable by everybody without the sticky bit, refusing it", dir)
+	}
+
+	return owner == 0 && !worldWritable, nil
+}
+
+// checkStateFile refuses a file of the state dir written by another user
+// than the invoking one or root, unless the dir is restricted.
+func checkStateFile(path string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file, refusing it", path)
+	}
+
+	owner, err := fileOwner(path, info)
+	if err != nil {
+		return err
+	}
+	if owner == os.Getuid() || owner == 0 {
+		return nil
+	}
+
+	restricted, err := checkStateDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !restricted {
+		return errors.Errorf("%s is owned by uid %d, neither you nor root, refusing it", path, owner)
+	}
+
+	return nil
+}
+
+func fileOwner(path string, info os.FileInfo) (int, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.Errorf("failed to get the owner of %s", path)
+	}
+
+	return int(st.Uid), nil
+}
+
+// readStateFile reads a file of the state dir, see checkStateFile. Symlinks
+// are not followed.
+func readStateFile(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStateFile(path, info); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(f)
+}
+
+// openLockFile opens path for flock, creating it and its directory. Locking
+// needs no write access, so lock files created by other users of a
+// restricted state dir work as well.
+func openLockFile(path string) (*os.File, error) {
+	if err := makeStateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY|syscall.O_NOFOLLOW, 0o644)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to open lock file %s", path)
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		err = checkStateFile(path, info)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// withFileLock runs fn while holding an exclusive flock on path, which
+// serialises concurrent invoker processes on the same host.
+func withFileLock(path string, fn func() error) error {
+	f, err := openLockFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.WithMessagef(err, "failed to lock %s", path)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// tryFileLock takes an exclusive flock on path without waiting, held is false
+// if another process has it. The lock lasts until release is called.
+func tryFileLock(path string) (release func(), held bool, err error) {
+	f, err := openLockFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, false, nil
+	} else if err != nil {
+		f.Close()
+		return nil, false, errors.WithMessagef(err, "failed to lock %s", path)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
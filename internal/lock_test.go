@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStateDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    os.FileMode
+		wantErr bool
+	}{
+		{"private", 0o700, false},
+		{"group", 0o770, false},
+		{"sticky", 0o777 | os.ModeSticky, false},
+		{"world writable", 0o777, true},
+	}
+
+	for _, tt := range tests {
+		dir := filepath.Join(t.TempDir(), "state")
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(dir, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := checkStateDir(dir); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkStateDir() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(t.TempDir(), link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkStateDir(link); err == nil {
+		t.Error("symlinked state dir was accepted")
+	}
+}
+
+func TestReadStateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queue.json")
+	if err := os.WriteFile(path, []byte("[]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := readStateFile(path); err != nil || string(content) != "[]" {
+		t.Errorf("readStateFile() = %q, %v", content, err)
+	}
+
+	if err := os.Chown(path, 4242, 4242); err != nil {
+		t.Skipf("can not hand the file to another user: %v", err)
+	}
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 {
+		// a dir owned by root that only root can write to is restricted
+		if _, err := readStateFile(path); err != nil {
+			t.Errorf("file of another user in a restricted dir: %v", err)
+		}
+		if err := os.Chown(dir, 4242, 4242); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := readStateFile(path); err == nil {
+		t.Error("file of another user was accepted")
+	}
+
+	link := filepath.Join(t.TempDir(), "ports.json")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readStateFile(link); err == nil {
+		t.Error("symlink was followed")
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	runStatusRunning   = "running"
+	runStatusFailed    = "failed"
+	runStatusCompleted = "completed"
+	runStatusKilled    = "killed"
+	// runStatusExited marks a run whose container is gone without invoker
+	// having seen how it ended.
+	runStatusExited = "exited"
+)
+
+type ManifestImage struct {
+	Tag     string   `json:"tag"`
+	ID      string   `json:"id,omitempty"`
+	Digests []string `json:"digests,omitempty"`
+}
+
+type ManifestResume struct {
+	// ContainerID is the container of the launch that was resumed.
+	ContainerID string `json:"container_id,omitempty"`
+	// Checkpoint is the host path of the checkpoint handed to the training
+	// code, empty if the run had none yet.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+type ManifestHost struct {
+	Hostname string `json:"hostname"`
+	// Address is the entry of --hosts this node matched.
+	Address string `json:"address"`
+}
+
+// RunManifest is written as run.json into the run directory of every node,
+// it records what was launched and how it ended.
+type RunManifest struct {
+	Project    string       `json:"project"`
+	Experiment string       `json:"experiment"`
+	Run        string       `json:"run"`
+	Args       RunArgs      `json:"args"`
+	Rank       int          `json:"rank"`
+	Master     string       `json:"master"`
+	Port       int          `json:"port"`
+	Command    []string     `json:"command"`
+	Host       ManifestHost `json:"host"`
+	// Endpoint is the docker daemon the run was launched through with
+	// --docker_endpoint, empty for the local one.
+	Endpoint      string        `json:"endpoint,omitempty"`
+	ContainerName string        `json:"container_name"`
+	ContainerID   string        `json:"container_id,omitempty"`
+	Image         ManifestImage `json:"image"`
+	Accelerator   string        `json:"accelerator"`
+	// GPUs holds the device indices given to the container, "all" if the
+	// whole host was.
+	GPUs string   `json:"gpus,omitempty"`
+	Git  *GitInfo `json:"git,omitempty"`
+	// ResumedFrom is set for launches of experiment resume.
+	ResumedFrom *ManifestResume `json:"resumed_from,omitempty"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	StartedAt   time.Time       `json:"started_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	ExitCode    *int            `json:"exit_code,omitempty"`
+	// RankExitCodes holds the exit codes of all ranks by rank, for runs
+	// launched with --docker_endpoint --wait, whose hosts write no run.json
+	// of their own.
+	RankExitCodes []*int `json:"rank_exit_codes,omitempty"`
+}
+
+func loadRunManifest(path string) (*RunManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	var manifest RunManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return &manifest, nil
+}
+
+func (m *RunManifest) save(path string) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode run manifest")
+	}
+
+	return writeFileAtomic(path, append(content, '\n'), 0o644, true)
+}
+
+// started fills in what docker reports about the freshly started container.
+func (m *RunManifest) started(info types.ContainerJSON, digests []string) {
+	m.ContainerID = info.ID
+	m.Image.ID = info.Image
+	m.Image.Digests = digests
+	m.GPUs = info.Config.Labels[labelGPUs]
+	m.Status = runStatusRunning
+
+	if startedAt, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil {
+		m.StartedAt = startedAt
+	}
+}
+
+// finished records how the container ended, killed tells whether invoker
+// stopped it.
+func (m *RunManifest) finished(state *types.ContainerState, killed bool) {
+	finishedAt := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil && !t.IsZero() {
+		finishedAt = t
+	}
+	m.FinishedAt = &finishedAt
+	m.ExitCode = PtrTo(state.ExitCode)
+
+	switch {
+	case killed:
+		m.Status = runStatusKilled
+	case state.ExitCode == 0:
+		m.Status = runStatusCompleted
+	default:
+		m.Status = runStatusFailed
+	}
+}
+
+// finalizeRunManifest updates the manifest of the run the container belongs
+// to before the container is removed, which loses its exit code.
+func (d *DockerRun) finalizeRunManifest(info types.ContainerJSON, killed bool) error {
+	labels := info.Config.Labels
+	project, experiment, run := labels[labelProject], labels[labelExperiment], labels[labelRun]
+	if project == "" || experiment == "" || run == "" {
+		return nil
+	}
+
+	path := d.layout.RunManifestPath(project, experiment, run)
+	manifest, err := loadRunManifest(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the run directory may have been reused by a later launch
+	if manifest.ContainerID != info.ID || manifest.FinishedAt != nil {
+		return nil
+	}
+
+	manifest.finished(info.State, killed)
+
+	return manifest.save(path)
+}
+
+func (d *DockerRun) imageDigests(imageID string) []string {
+	image, _, err := d.client.ImageInspectWithRaw(d.ctx, imageID)
+	if err != nil {
+		return nil
+	}
+
+	return image.RepoDigests
+}
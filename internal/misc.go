@@ -87,16 +87,6 @@ func rankAndMasterElseExit(hosts []string) (string, int) {
 	return master, rank
 }
 
-func portIsAvailable(port int) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		fmt.Printf("port %d is already in use\n", port)
-		os.Exit(1)
-	}
-
-	defer listener.Close()
-}
-
 type Path struct {
 	path string
 }
@@ -121,24 +111,9 @@ func (p *Path) Join(subpath string) *Path {
 	return &Path{path: filepath.Join(p.path, subpath)}
 }
 
-func makeDefaultDirectories(projectName, experimentName, runName string) (string, string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", "", errors.WithMessage(err, "failed to get user home directory")
-	}
-
-	cacheDir := Path{path: filepath.Join(home, ".cache")}
-	if err = cacheDir.mkdirIfNotExists(); err != nil {
-		return "", "", errors.WithMessage(err, "failed to create cache directory")
-	}
-
-	checkpointDir := cacheDir.Join("higgsfield").Join(projectName).Join("experiments").Join(experimentName).Join(runName)
-	if err = checkpointDir.mkdirIfNotExists(); err != nil {
-		return "", "", errors.WithMessagef(err, "failed to create checkpoint directory for experiment %s and run name %s", experimentName, runName)
-	}
-
-	return cacheDir.path, checkpointDir.path, nil
-}
+// StringArray is parsed from a repeatable flag whose values may contain
+// commas, unlike []string which is split on them.
+type StringArray []string
 
 type errStrategyFunc func(flag string, err error)
 
@@ -151,21 +126,21 @@ func exitIfError(flag string, err error) {
 
 func nothingIfError(flag string, err error) {}
 
-func ParseOrNil[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string) *T {
-  // TODO: buddy, need to fix this
-  got, ok := parseOrExitInternal[T](cmd, flag, false)
+func ParseOrNil[T ~string | ~int | ~bool | ~[]string](cmd *cobra.Command, flag string) *T {
+	// TODO: buddy, need to fix this
+	got, ok := parseOrExitInternal[T](cmd, flag, false)
 	if !ok {
 		return nil
 	}
 	return PtrTo(got.(T))
 }
 
-func ParseOrExit[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string) T {
+func ParseOrExit[T ~string | ~int | ~bool | ~[]string](cmd *cobra.Command, flag string) T {
 	got, _ := parseOrExitInternal[T](cmd, flag, true)
 	return got.(T)
 }
 
-func parseOrExitInternal[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string, exit bool) (interface{}, bool) {
+func parseOrExitInternal[T ~string | ~int | ~bool | ~[]string](cmd *cobra.Command, flag string, exit bool) (interface{}, bool) {
 	errFunc := nothingIfError
 
 	if exit {
@@ -182,6 +157,14 @@ func parseOrExitInternal[T ~string | ~int | ~[]string](cmd *cobra.Command, flag
 		v, err := cmd.Flags().GetInt(flag)
 		errFunc(flag, err)
 		return v, err == nil
+	case bool:
+		v, err := cmd.Flags().GetBool(flag)
+		errFunc(flag, err)
+		return v, err == nil
+	case StringArray:
+		v, err := cmd.Flags().GetStringArray(flag)
+		errFunc(flag, err)
+		return StringArray(v), err == nil
 	case []string:
 		v, err := cmd.Flags().GetStringSlice(flag)
 		errFunc(flag, err)
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	mountTypeBind   = "bind"
+	mountTypeVolume = "volume"
+	mountTypeTmpfs  = "tmpfs"
+)
+
+// MountSpec is an extra mount for the experiment container, given either in
+// the project config or with --mount.
+type MountSpec struct {
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	// TmpfsSize limits tmpfs mounts, e.g. 8g.
+	TmpfsSize string `json:"tmpfs_size,omitempty"`
+}
+
+// parseMountSpec parses the docker --mount syntax, e.g.
+// type=bind,source=/data,target=/data,readonly or
+// type=tmpfs,target=/scratch,tmpfs-size=8g. The type defaults to volume.
+func parseMountSpec(spec string) (MountSpec, error) {
+	m := MountSpec{Type: mountTypeVolume}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(field), "=")
+		switch strings.ToLower(key) {
+		case "type":
+			m.Type = value
+		case "source", "src":
+			m.Source = value
+		case "target", "destination", "dst":
+			m.Target = value
+		case "readonly", "ro":
+			m.ReadOnly = !hasValue || value == "true" || value == "1"
+		case "tmpfs-size":
+			m.TmpfsSize = value
+		default:
+			return MountSpec{}, errors.Errorf("unknown mount option %q in %q", key, spec)
+		}
+	}
+
+	return m, nil
+}
+
+// validate checks the spec and, for bind mounts, that the host path exists.
+func (m MountSpec) validate() error {
+	if m.Target == "" || !path.IsAbs(m.Target) {
+		return errors.Errorf("mount target %q must be an absolute path", m.Target)
+	}
+
+	switch m.Type {
+	case mountTypeBind:
+		if m.Source == "" {
+			return errors.Errorf("bind mount to %s needs a source", m.Target)
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			return errors.WithMessagef(err, "bind mount source for %s", m.Target)
+		}
+	case mountTypeVolume:
+	case mountTypeTmpfs:
+		if m.Source != "" {
+			return errors.Errorf("tmpfs mount to %s cannot have a source", m.Target)
+		}
+		if m.TmpfsSize != "" {
+			if _, err := units.RAMInBytes(m.TmpfsSize); err != nil {
+				return errors.WithMessagef(err, "invalid tmpfs size for %s", m.Target)
+			}
+		}
+	default:
+		return errors.Errorf("unknown mount type %q for %s, expected bind, volume or tmpfs", m.Type, m.Target)
+	}
+
+	if m.TmpfsSize != "" && m.Type != mountTypeTmpfs {
+		return errors.Errorf("tmpfs-size is only valid for tmpfs mounts, %s is a %s mount", m.Target, m.Type)
+	}
+
+	return nil
+}
+
+// dockerMount must only be called on validated specs.
+func (m MountSpec) dockerMount() mount.Mount {
+	dm := mount.Mount{
+		Type:     mount.Type(m.Type),
+		Source:   m.Source,
+		Target:   m.Target,
+		ReadOnly: m.ReadOnly,
+	}
+
+	if m.Type == mountTypeTmpfs && m.TmpfsSize != "" {
+		size, _ := units.RAMInBytes(m.TmpfsSize)
+		dm.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: size}
+	}
+
+	return dm
+}
+
+// builtinMountTarget tells whether target is bound by invoker itself, see
+// containerConfig: the project at /srv and the invoker cache of both users,
+// with everything below it, and the shared caches unless they are isolated.
+func builtinMountTarget(target string, sharedCaches bool) bool {
+	target = path.Clean(target)
+	if target == path.Clean(guestRootPath) {
+		return true
+	}
+
+	subdirs := []string{guestCacheSubdir}
+	if sharedCaches {
+		subdirs = append(subdirs, sharedCacheSubdirs...)
+	}
+
+	var caches []string
+	for _, subdir := range subdirs {
+		caches = append(caches, guestCachePath+subdir, guestRootCachePath+subdir)
+	}
+
+	for _, cache := range caches {
+		cache = path.Clean(cache)
+		if target == cache || strings.HasPrefix(target, cache+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveMounts validates the project and command line mounts and converts
+// them for the container spec. Relative bind sources are taken relative to
+// the working directory, as docker only accepts absolute ones.
+func resolveMounts(config []MountSpec, flags []string, sharedCaches bool) ([]mount.Mount, error) {
+	specs := append([]MountSpec{}, config...)
+	for _, flag := range flags {
+		m, err := parseMountSpec(flag)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, m)
+	}
+
+	targets := make(map[string]bool, len(specs))
+	mounts := make([]mount.Mount, 0, len(specs))
+	for _, m := range specs {
+		if m.Type == mountTypeBind && m.Source != "" && !filepath.IsAbs(m.Source) {
+			source, err := filepath.Abs(m.Source)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to resolve bind mount source %s", m.Source)
+			}
+			m.Source = source
+		}
+
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+
+		if builtinMountTarget(m.Target, sharedCaches) {
+			return nil, errors.Errorf("mount target %s is already used by invoker for the project or the cache", m.Target)
+		}
+		if targets[path.Clean(m.Target)] {
+			return nil, errors.Errorf("more than one mount targets %s", m.Target)
+		}
+		targets[path.Clean(m.Target)] = true
+
+		mounts = append(mounts, m.dockerMount())
+	}
+
+	return mounts, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	runNameStyleName      = "name"
+	runNameStyleTimestamp = "timestamp"
+
+	// runNonceEnv is read when --run_nonce is not given.
+	runNonceEnv = "INVOKER_RUN_NONCE"
+
+	// maxRunNameDraws bounds the names tried before giving up, there are
+	// only a few thousand
+	maxRunNameDraws = 64
+)
+
+// the same flavour as docker container names, kept here because the docker
+// generator can not be seeded
+var (
+	runNameAdjectives = []string{
+		"admiring", "agitated", "amazing", "awesome", "blissful", "bold", "brave", "charming",
+		"clever", "compassionate", "confident", "cool", "dazzling", "determined", "eager", "ecstatic",
+		"elegant", "epic", "festive", "focused", "friendly", "gallant", "gifted", "gracious",
+		"happy", "hopeful", "inspiring", "jolly", "keen", "kind", "laughing", "loving",
+		"lucid", "magical", "modest", "nice", "nifty", "nostalgic", "optimistic", "peaceful",
+		"pensive", "practical", "quirky", "relaxed", "serene", "sharp", "stoic", "sweet",
+		"tender", "trusting", "upbeat", "vibrant", "vigilant", "wizardly", "wonderful", "youthful",
+		"zealous", "zen",
+	}
+	runNameSurnames = []string{
+		"agnesi", "almeida", "archimedes", "babbage", "bardeen", "bell", "bohr", "boole",
+		"cerf", "curie", "darwin", "dijkstra", "einstein", "euclid", "euler", "fermat",
+		"fermi", "feynman", "gauss", "goldberg", "goodall", "hamilton", "hawking", "heisenberg",
+		"hopper", "hypatia", "johnson", "kepler", "knuth", "kowalevski", "lamport", "leakey",
+		"liskov", "lovelace", "mayer", "mccarthy", "meitner", "mirzakhani", "moore", "newton",
+		"noether", "pascal", "pike", "planck", "ritchie", "shannon", "sinoussi", "thompson",
+		"torvalds", "turing", "varahamihira", "wiles", "wozniak", "wright", "yalow", "yonath",
+	}
+)
+
+// runNameTaken tells whether a run of the experiment uses name already. A run
+// recorded with the same nonce is the one being launched, seen from another
+// host on a shared cache, and does not count. Hosts draw their names before
+// preflight, so before any of them creates the run directory.
+func runNameTaken(layout *Layout, project, experiment string) func(name, nonce string) bool {
+	return func(name, nonce string) bool {
+		if _, err := os.Stat(layout.RunDir(project, experiment, name)); err != nil {
+			return false
+		}
+
+		manifest, err := loadRunManifest(layout.RunManifestPath(project, experiment, name))
+		return err != nil || nonce == "" || manifest.Args.RunNonce != nonce
+	}
+}
+
+// generateRunName derives a run name from the experiment and a nonce, every
+// host given the same nonce comes up with the same name. Without a nonce a
+// single host picks one itself, several hosts can not agree on one. A single
+// host draws a taken name again from the same seed. Several hosts each check
+// their own cache, and a name taken on one host only would be drawn again on
+// that host alone, so they give up and ask for --run_name instead.
+func generateRunName(experimentName, style, nonce string, multiHost bool, taken func(name, nonce string) bool) (string, error) {
+	if nonce == "" {
+		nonce = os.Getenv(runNonceEnv)
+	}
+	if nonce == "" && multiHost {
+		return "", errors.Errorf("pass --run_name, or --run_nonce (or $%s) with the same value on every host, e.g. $(date +%%s)", runNonceEnv)
+	}
+	given := nonce
+
+	var next func(draw int) string
+	switch style {
+	case "", runNameStyleName:
+		if nonce == "" {
+			nonce = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(experimentName + "\x00" + nonce))
+		r := rand.New(rand.NewSource(int64(h.Sum64())))
+
+		next = func(int) string {
+			return runNameAdjectives[r.Intn(len(runNameAdjectives))] + "_" + runNameSurnames[r.Intn(len(runNameSurnames))]
+		}
+	case runNameStyleTimestamp:
+		t := time.Now()
+		if nonce != "" {
+			seconds, err := strconv.ParseInt(nonce, 10, 64)
+			if err != nil {
+				return "", errors.Errorf("timestamp run names need a unix timestamp as nonce, got %q", nonce)
+			}
+			t = time.Unix(seconds, 0)
+		}
+
+		name := "run_" + t.UTC().Format("20060102_150405")
+		next = func(draw int) string {
+			if draw == 0 {
+				return name
+			}
+			return fmt.Sprintf("%s_%d", name, draw+1)
+		}
+	default:
+		return "", errors.Errorf("invalid run name style %q, expected %s or %s", style, runNameStyleName, runNameStyleTimestamp)
+	}
+
+	for draw := 0; draw < maxRunNameDraws; draw++ {
+		name := next(draw)
+		if !taken(name, given) {
+			return name, nil
+		}
+		if multiHost {
+			return "", errors.Errorf("generated run name %s is taken on this host, the other hosts might not see it, pass --run_name", name)
+		}
+	}
+
+	return "", errors.Errorf("the first %d run names drawn for experiment %s are taken, pass --run_name or another --run_nonce", maxRunNameDraws, experimentName)
+}
+
+func printGeneratedRunName(runName string) {
+	fmt.Printf(`
+  ┌──────────────────────────────────────────────
+  │  no --run_name given, generated run name:
+  │
+  │      %s
+  │
+  │  pass --run_name=%s to refer to this run
+  └──────────────────────────────────────────────
+`, runName, runName)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestGenerateRunNameRedraws(t *testing.T) {
+	free := func(string, string) bool { return false }
+	first, err := generateRunName("exp", runNameStyleName, "42", false, free)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	takenFirst := func(name, _ string) bool { return name == first }
+	second, err := generateRunName("exp", runNameStyleName, "42", false, takenFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("taken name %s was drawn again", first)
+	}
+	if again, _ := generateRunName("exp", runNameStyleName, "42", false, takenFirst); again != second {
+		t.Errorf("redraw is not deterministic: %s, then %s", second, again)
+	}
+
+	stamp, err := generateRunName("exp", runNameStyleTimestamp, "0", false, func(name, _ string) bool { return name == "run_19700101_000000" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp != "run_19700101_000000_2" {
+		t.Errorf("timestamp name = %s, want run_19700101_000000_2", stamp)
+	}
+
+	all := func(string, string) bool { return true }
+	if _, err := generateRunName("exp", runNameStyleName, "42", false, all); err == nil {
+		t.Error("no error when every name is taken")
+	}
+}
+
+func TestGenerateRunNameMultiHost(t *testing.T) {
+	t.Setenv("INVOKER_STATE_DIR", t.TempDir())
+	var layouts [2]*Layout
+	for i := range layouts {
+		layout, err := NewLayout(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		layouts[i] = layout
+	}
+
+	name, err := generateRunName("exp", runNameStyleName, "42", true, runNameTaken(layouts[0], "proj", "exp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an older run of another nonce holds the name on the second host only
+	if err := layouts[1].MakeRunDirs("proj", "exp", name); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &RunManifest{Args: RunArgs{RunNonce: "41"}}
+	if err := manifest.save(layouts[1].RunManifestPath("proj", "exp", name)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := generateRunName("exp", runNameStyleName, "42", true, runNameTaken(layouts[0], "proj", "exp")); err != nil || got != name {
+		t.Errorf("first host: got %s, %v, want %s", got, err, name)
+	}
+	if got, err := generateRunName("exp", runNameStyleName, "42", true, runNameTaken(layouts[1], "proj", "exp")); err == nil {
+		t.Errorf("second host drew %s instead of failing", got)
+	}
+}
+
+func TestRunNameTaken(t *testing.T) {
+	t.Setenv("INVOKER_STATE_DIR", t.TempDir())
+	layout, err := NewLayout(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := runNameTaken(layout, "proj", "exp")
+	if taken("focused_euclid", "42") {
+		t.Error("missing run directory is taken")
+	}
+
+	if err := layout.MakeRunDirs("proj", "exp", "focused_euclid"); err != nil {
+		t.Fatal(err)
+	}
+	if !taken("focused_euclid", "42") {
+		t.Error("run directory without a manifest is not taken")
+	}
+
+	manifest := &RunManifest{Args: RunArgs{RunNonce: "42"}}
+	if err := manifest.save(layout.RunManifestPath("proj", "exp", "focused_euclid")); err != nil {
+		t.Fatal(err)
+	}
+	if taken("focused_euclid", "42") {
+		t.Error("run of the same nonce is taken")
+	}
+	if !taken("focused_euclid", "43") {
+		t.Error("run of another nonce is not taken")
+	}
+	if !taken("focused_euclid", "") {
+		t.Error("run is not taken without a nonce")
+	}
+}
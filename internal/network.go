@@ -2,10 +2,51 @@ package internal
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
+const DefaultPortRange = "1024-65535"
+
+type PortRange struct {
+	Min int
+	Max int
+}
+
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		return PortRange{}, errors.Errorf("port range %q must look like min-max", s)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return PortRange{}, errors.WithMessagef(err, "invalid port range %q", s)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return PortRange{}, errors.WithMessagef(err, "invalid port range %q", s)
+	}
+
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, errors.Errorf("port range %q must be within 1-65535 and min <= max", s)
+	}
+
+	return PortRange{Min: min, Max: max}, nil
+}
+
+func (r PortRange) size() int {
+	return r.Max - r.Min + 1
+}
+
 func isPortAvailable(port int) bool {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -16,10 +57,81 @@ func isPortAvailable(port int) bool {
 	return true
 }
 
-func GeneratePort() int {
-	port := rand.Intn(65535-1024) + 1024
-	for !isPortAvailable(port) {
-		port = rand.Intn(65535-1024) + 1024
+func randomPort(r PortRange, taken map[int]string) (int, error) {
+	// give up eventually instead of spinning on a fully used range
+	for i := 0; i < 4*r.size(); i++ {
+		port := rand.Intn(r.size()) + r.Min
+		if _, ok := taken[port]; !ok && isPortAvailable(port) {
+			return port, nil
+		}
+	}
+
+	return 0, errors.Errorf("no available port in range %d-%d", r.Min, r.Max)
+}
+
+// hashedPort maps the identity into the range. It looks at nothing on the
+// node, so every node of a run comes up with the same port; only the master
+// binds it, and a port that is busy there fails the launch instead of moving.
+func hashedPort(r PortRange, identity ...string) int {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(identity, "/")))
+
+	return r.Min + int(h.Sum64()%uint64(r.size()))
+}
+
+type GeneratePortArgs struct {
+	Range          string
+	ProjectName    string
+	ExperimentName string
+	RunName        string
+	Reserve        bool
+	Owner          string
+	TTL            int `validate:"min=0"`
+	CacheDir       string
+}
+
+func GeneratePort(args GeneratePortArgs) int {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	r, err := ParsePortRange(args.Range)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	pick := func(taken map[int]string) (int, error) {
+		if args.ProjectName == "" && args.ExperimentName == "" && args.RunName == "" {
+			return randomPort(r, taken)
+		}
+		port := hashedPort(r, args.ProjectName, args.ExperimentName, args.RunName)
+		if holder, ok := taken[port]; ok {
+			return 0, errors.Errorf("port %d derived from the run identity is reserved by %s, use another run name", port, valueOr(holder, "an anonymous reservation"))
+		}
+		return port, nil
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	leases := newPortLeases(layout)
+
+	var port int
+	if args.Reserve {
+		port, err = leases.reserve(args.Owner, time.Duration(args.TTL)*time.Second, pick)
+	} else {
+		var taken map[int]string
+		if taken, err = leases.taken(); err == nil {
+			port, err = pick(taken)
+		}
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	return port
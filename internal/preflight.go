@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const preflightHello = "invoker-preflight"
+
+// masterPreflight binds the master port on rank 0 and waits until every
+// other rank has connected to it, so firewall and routing problems show up
+// before torchrun is started.
+func masterPreflight(hosts []string, port int, timeout time.Duration) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return errors.WithMessagef(err, "master port %d is not available", port)
+	}
+	defer listener.Close()
+
+	if len(hosts) < 2 || timeout == 0 {
+		return nil
+	}
+
+	fmt.Printf("waiting up to %s for %d hosts to reach port %d\n", timeout, len(hosts)-1, port)
+	if err := listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.WithMessage(err, "failed to set listener deadline")
+	}
+
+	seen := make(map[int]bool, len(hosts)-1)
+	for len(seen) < len(hosts)-1 {
+		conn, err := listener.Accept()
+		if err != nil {
+			missing := make([]string, 0, len(hosts))
+			for rank := 1; rank < len(hosts); rank++ {
+				if !seen[rank] {
+					missing = append(missing, fmt.Sprintf("%s (rank %d)", hosts[rank], rank))
+				}
+			}
+			return errors.Errorf(
+				"hosts %s did not reach port %d within %s, check firewall rules and routing between the hosts",
+				strings.Join(missing, ", "), port, timeout,
+			)
+		}
+
+		if rank, ok := acceptPreflightPeer(conn, len(hosts)); ok {
+			fmt.Printf("%s (rank %d) reached port %d\n", hosts[rank], rank, port)
+			seen[rank] = true
+		}
+	}
+
+	return nil
+}
+
+func acceptPreflightPeer(conn net.Conn, worldSize int) (int, bool) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, false
+	}
+
+	hello, rankStr, _ := strings.Cut(strings.TrimSpace(line), " ")
+	rank, err := strconv.Atoi(rankStr)
+	if hello != preflightHello || err != nil || rank < 1 || rank >= worldSize {
+		// not one of ours, e.g. a port scanner
+		return 0, false
+	}
+
+	if _, err := conn.Write([]byte("ok\n")); err != nil {
+		return 0, false
+	}
+
+	// let the peer close first so the master port is not left in TIME_WAIT
+	reader.ReadString('\n')
+
+	return rank, true
+}
+
+// workerPreflight keeps dialing master:port until rank 0 answers or the
+// timeout runs out.
+func workerPreflight(master string, port, rank int, timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	addr := net.JoinHostPort(master, strconv.Itoa(port))
+	fmt.Printf("checking that master %s is reachable\n", addr)
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if lastErr = dialPreflight(addr, rank); lastErr == nil {
+			fmt.Printf("master %s is reachable\n", addr)
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+
+	return errors.WithMessagef(
+		lastErr,
+		"master %s is not reachable after %s, check firewall rules and routing between the hosts",
+		addr, timeout,
+	)
+}
+
+func dialPreflight(addr string, rank int) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintf(conn, "%s %d\n", preflightHello, rank); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(line) != "ok" {
+		return errors.Errorf("unexpected answer %q, is something else listening on %s?", line, addr)
+	}
+
+	return nil
+}
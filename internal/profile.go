@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HostProfile describes what a kind of host needs from the container on top
+// of the project defaults. Built-in profiles cover the platforms we run on,
+// more can be added as JSON files in the profile directories.
+type HostProfile struct {
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description,omitempty"`
+	// DeviceRequests asks the container runtime hook (e.g. nvidia) for the
+	// accelerators. Without it only plain device mappings are used.
+	DeviceRequests bool `json:"device_requests"`
+	// Binds are host:container[:options] mounts, skipped if the host path
+	// does not exist.
+	Binds []string `json:"binds,omitempty"`
+	// Devices are extra device nodes mapped when present.
+	Devices []string `json:"devices,omitempty"`
+	CapAdd  []string `json:"cap_add,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	// BindEnv is set only when the bind of the host path it is keyed by is
+	// applied, for settings that point into that bind.
+	BindEnv map[string][]string `json:"bind_env,omitempty"`
+	Detect  *HostProfileDetect  `json:"detect,omitempty"`
+}
+
+// HostProfileDetect lists the conditions under which a profile is picked by
+// --host_profile=auto. All given conditions have to hold.
+type HostProfileDetect struct {
+	// OSID matches the ID field of /etc/os-release.
+	OSID string `json:"os_id,omitempty"`
+	// SysVendors matches /sys/class/dmi/id/sys_vendor, any of them.
+	SysVendors []string `json:"sys_vendors,omitempty"`
+	// Paths must all exist.
+	Paths []string `json:"paths,omitempty"`
+}
+
+var builtinHostProfiles = []HostProfile{
+	{
+		Name:        "cos-tcpx",
+		Description: "Container-Optimized OS, optionally with GPUDirect-TCPX",
+		// the nvidia runtime hook is not available on cos, devices are
+		// mapped directly
+		DeviceRequests: false,
+		Binds:          []string{"/run/tcpx:/run/tcpx"},
+		CapAdd:         []string{"NET_ADMIN"},
+		// without the tcpx daemon socket nccl would fail to start instead of
+		// falling back to plain tcp
+		BindEnv: map[string][]string{
+			"/run/tcpx": {"NCCL_GPUDIRECTTCPX_UNIX_CLIENT_PREFIX=/run/tcpx"},
+		},
+		Detect: &HostProfileDetect{OSID: "cos"},
+	},
+	{
+		Name:           "cloud-vm",
+		Description:    "virtual machine on a public cloud",
+		DeviceRequests: true,
+		CapAdd:         []string{"NET_ADMIN"},
+		Detect: &HostProfileDetect{
+			SysVendors: []string{"Google", "Amazon EC2", "Microsoft Corporation"},
+		},
+	},
+	{
+		Name:           "bare-metal",
+		Description:    "any other host",
+		DeviceRequests: true,
+		CapAdd:         []string{"NET_ADMIN"},
+	},
+}
+
+// hostProfileDirs are searched for custom profiles, one JSON file each.
+func hostProfileDirs() []string {
+	dirs := []string{"/etc/invoker/profiles"}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(configDir, "invoker", "profiles"))
+	}
+
+	return dirs
+}
+
+func loadCustomHostProfiles(dirs []string) ([]HostProfile, error) {
+	profiles := make([]HostProfile, 0)
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to list %s", dir)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to read host profile %s", path)
+			}
+
+			var profile HostProfile
+			if err := json.Unmarshal(content, &profile); err != nil {
+				return nil, errors.WithMessagef(err, "failed to parse host profile %s", path)
+			}
+
+			if err := Validator().Struct(profile); err != nil {
+				return nil, errors.WithMessagef(err, "invalid host profile %s", path)
+			}
+
+			profiles = append(profiles, profile)
+		}
+	}
+
+	return profiles, nil
+}
+
+// selectHostProfile returns the profile called name, or for "auto" the first
+// profile whose detection matches the host under root. Custom profiles take
+// precedence over built-in ones with the same name and are tried first.
+func selectHostProfile(root, name string, custom []HostProfile) (HostProfile, error) {
+	profiles := append(append([]HostProfile{}, custom...), builtinHostProfiles...)
+
+	if name != "" && name != "auto" {
+		for _, profile := range profiles {
+			if profile.Name == name {
+				return profile, nil
+			}
+		}
+
+		names := make([]string, 0, len(profiles))
+		for _, profile := range profiles {
+			names = append(names, profile.Name)
+		}
+		return HostProfile{}, errors.Errorf("unknown host profile %q, expected auto or one of %s", name, strings.Join(names, ", "))
+	}
+
+	for _, profile := range profiles {
+		if profile.Detect != nil && profile.Detect.matches(root) {
+			return profile, nil
+		}
+	}
+
+	// bare-metal is the fallback
+	return builtinHostProfiles[len(builtinHostProfiles)-1], nil
+}
+
+func (d *HostProfileDetect) matches(root string) bool {
+	if d.OSID != "" && osReleaseID(root) != d.OSID {
+		return false
+	}
+
+	if len(d.SysVendors) > 0 {
+		content, err := os.ReadFile(hostPath(root, "/sys/class/dmi/id/sys_vendor"))
+		if err != nil {
+			return false
+		}
+
+		vendor := strings.TrimSpace(string(content))
+		matched := false
+		for _, v := range d.SysVendors {
+			matched = matched || strings.HasPrefix(vendor, v)
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return len(existingPaths(root, d.Paths)) == len(d.Paths)
+}
+
+func osReleaseID(root string) string {
+	file, err := os.Open(hostPath(root, "/etc/os-release"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "ID="), `"`)
+		}
+	}
+
+	return ""
+}
+
+// binds returns the profile binds whose host path exists under root.
+func (p HostProfile) binds(root string) []string {
+	binds := make([]string, 0, len(p.Binds))
+	for _, bind := range p.Binds {
+		source, _, _ := strings.Cut(bind, ":")
+		if _, err := os.Stat(hostPath(root, source)); err != nil {
+			continue
+		}
+
+		fmt.Printf("host profile %s: adding %s to binds\n", p.Name, source)
+		binds = append(binds, bind)
+	}
+
+	return binds
+}
+
+// bindEnv returns the env of the given binds, in the order of the binds.
+func (p HostProfile) bindEnv(binds []string) []string {
+	env := make([]string, 0)
+	for _, bind := range binds {
+		source, _, _ := strings.Cut(bind, ":")
+		env = append(env, p.BindEnv[source]...)
+	}
+
+	return env
+}
@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+type PruneArgs struct {
+	ProjectName    string `validate:"omitempty,varname"`
+	ExperimentName string `validate:"omitempty,varname"`
+	KeepLast       int    `validate:"min=0"`
+	OlderThan      string
+	MaxTotalSize   string
+	KeepTagged     bool
+	DryRun         bool
+	CacheDir       string
+}
+
+// parseAge parses a go duration, with d for days on top.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, errors.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("invalid age %q, expected e.g. 36h or 30d", s)
+	}
+
+	return d, nil
+}
+
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+
+	return d.String()
+}
+
+// runTime orders the runs of an experiment, by launch if known.
+func runTime(r runEntry) time.Time {
+	if r.Manifest != nil && !r.Manifest.StartedAt.IsZero() {
+		return r.Manifest.StartedAt
+	}
+
+	return r.ModifiedAt
+}
+
+// pruneGracePeriod protects runs launched so recently that their containers
+// might not be up yet.
+const pruneGracePeriod = time.Hour
+
+type prunePolicy struct {
+	// KeepLast keeps the newest runs of every experiment, 0 disables it.
+	KeepLast int
+	// OlderThan keeps runs modified more recently, 0 disables it.
+	OlderThan time.Duration
+	// MaxTotalSize deletes the oldest runs until the rest fits, 0 disables it.
+	MaxTotalSize int64
+	KeepTagged   bool
+	// Grace protects runs launched or modified more recently.
+	Grace time.Duration
+	// Hostname is the host whose docker daemon the statuses come from.
+	Hostname string
+}
+
+// protected tells whether a run is never deleted: running runs, runs of an
+// unknown status, runs launched within the grace period, runs whose
+// containers live on other hosts and were never seen finishing there, and,
+// with KeepTagged, tagged runs.
+func (p prunePolicy) protected(r runEntry, now time.Time) bool {
+	switch {
+	case r.Status == runStatusRunning || r.Status == runStatusUnknown:
+		return true
+	case p.KeepTagged && len(r.Tags) > 0:
+		return true
+	case now.Sub(runTime(r)) < p.Grace || now.Sub(r.ModifiedAt) < p.Grace:
+		return true
+	}
+
+	// the local daemon does not know the containers of other hosts, their
+	// runs only look exited
+	m := r.Manifest
+	if m == nil {
+		return true
+	}
+	remote := m.Endpoint != "" || m.Host.Hostname != p.Hostname || len(m.Args.Hosts) > 1
+	return remote && m.FinishedAt == nil
+}
+
+type pruneDecision struct {
+	Run    runEntry
+	Reason string
+}
+
+// selectPrunable returns the runs the policy deletes. KeepLast and OlderThan
+// each keep a run, a run kept by neither is deleted. MaxTotalSize then goes
+// on with the oldest runs left. Protected runs are never deleted.
+func (p prunePolicy) selectPrunable(runs []runEntry, now time.Time) []pruneDecision {
+	protected := func(r runEntry) bool {
+		return p.protected(r, now)
+	}
+
+	byExperiment := map[string][]runEntry{}
+	for _, r := range runs {
+		key := r.Project + "/" + r.Experiment
+		byExperiment[key] = append(byExperiment[key], r)
+	}
+
+	newest := map[string]bool{}
+	for _, experimentRuns := range byExperiment {
+		sort.SliceStable(experimentRuns, func(i, j int) bool {
+			return runTime(experimentRuns[i]).After(runTime(experimentRuns[j]))
+		})
+		for i, r := range experimentRuns {
+			if i < p.KeepLast {
+				newest[r.Path] = true
+			}
+		}
+	}
+
+	var decisions []pruneDecision
+	deleted := map[string]bool{}
+	if p.KeepLast > 0 || p.OlderThan > 0 {
+		for _, r := range runs {
+			if protected(r) || (p.KeepLast > 0 && newest[r.Path]) || (p.OlderThan > 0 && now.Sub(r.ModifiedAt) < p.OlderThan) {
+				continue
+			}
+
+			var reasons []string
+			if p.KeepLast > 0 {
+				reasons = append(reasons, fmt.Sprintf("not among the last %d", p.KeepLast))
+			}
+			if p.OlderThan > 0 {
+				reasons = append(reasons, "older than "+formatAge(p.OlderThan))
+			}
+			decisions = append(decisions, pruneDecision{Run: r, Reason: strings.Join(reasons, ", ")})
+			deleted[r.Path] = true
+		}
+	}
+
+	if p.MaxTotalSize > 0 {
+		var total int64
+		var left []runEntry
+		for _, r := range runs {
+			if !deleted[r.Path] {
+				total += r.Size
+				left = append(left, r)
+			}
+		}
+
+		sort.SliceStable(left, func(i, j int) bool {
+			return runTime(left[i]).Before(runTime(left[j]))
+		})
+
+		for _, r := range left {
+			if total <= p.MaxTotalSize {
+				break
+			}
+			if protected(r) {
+				continue
+			}
+
+			decisions = append(decisions, pruneDecision{Run: r, Reason: fmt.Sprintf("total size above %s", units.BytesSize(float64(p.MaxTotalSize)))})
+			total -= r.Size
+		}
+	}
+
+	return decisions
+}
+
+func Prune(args PruneArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("failed to get hostname: %v\n", err)
+		os.Exit(1)
+	}
+
+	policy := prunePolicy{KeepLast: args.KeepLast, KeepTagged: args.KeepTagged, Grace: pruneGracePeriod, Hostname: hostname}
+
+	if args.OlderThan != "" {
+		d, err := parseAge(args.OlderThan)
+		if err != nil {
+			fmt.Printf("invalid --older_than: %v\n", err)
+			os.Exit(1)
+		}
+		policy.OlderThan = d
+	}
+
+	if args.MaxTotalSize != "" {
+		size, err := units.RAMInBytes(args.MaxTotalSize)
+		if err != nil {
+			fmt.Printf("invalid --max_total_size: %v\n", err)
+			os.Exit(1)
+		}
+		policy.MaxTotalSize = size
+	}
+
+	if policy.KeepLast == 0 && policy.OlderThan == 0 && policy.MaxTotalSize == 0 {
+		fmt.Println("no retention policy given, use --keep_last, --older_than or --max_total_size")
+		os.Exit(1)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// without docker there is no telling which runs are still being written to
+	containers, err := runningRuns(context.Background())
+	if err != nil {
+		fmt.Printf("refusing to prune: %v\n", err)
+		os.Exit(1)
+	}
+
+	runs, err := scanRuns(layout, runFilter{ProjectName: args.ProjectName, ExperimentName: args.ExperimentName}, containers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	decisions := policy.selectPrunable(runs, time.Now())
+	if len(decisions) == 0 {
+		fmt.Println("nothing to prune")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PROJECT\tEXPERIMENT\tRUN\tSIZE\tMODIFIED\tREASON\n")
+	var size int64
+	for _, d := range decisions {
+		r := d.Run
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Project, r.Experiment, r.Run, units.BytesSize(float64(r.Size)), formatModified(r.ModifiedAt), d.Reason)
+		size += r.Size
+	}
+	w.Flush()
+
+	if args.DryRun {
+		fmt.Printf("would delete %d runs, %s\n", len(decisions), units.BytesSize(float64(size)))
+		return
+	}
+
+	deleted, freed := 0, int64(0)
+	for _, d := range decisions {
+		if err := os.RemoveAll(d.Run.Path); err != nil {
+			fmt.Printf("failed to delete %s: %v\n", d.Run.Path, err)
+			continue
+		}
+		deleted++
+		freed += d.Run.Size
+	}
+
+	fmt.Printf("deleted %d runs, %s\n", deleted, units.BytesSize(float64(freed)))
+	if deleted != len(decisions) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrunePolicyProtected(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+	finished := old.Add(time.Hour)
+
+	local := func(status string) runEntry {
+		return runEntry{
+			Run:        status,
+			Status:     status,
+			ModifiedAt: old,
+			Manifest: &RunManifest{
+				Status:     status,
+				Host:       ManifestHost{Hostname: "node1"},
+				Args:       RunArgs{Hosts: []string{"localhost"}},
+				StartedAt:  old,
+				FinishedAt: &finished,
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		run       func(r *runEntry)
+		protected bool
+	}{
+		{"completed", func(r *runEntry) {}, false},
+		{"running", func(r *runEntry) { r.Status = runStatusRunning }, true},
+		{"unknown", func(r *runEntry) { r.Status, r.Manifest = runStatusUnknown, nil }, true},
+		{"tagged", func(r *runEntry) { r.Tags = []string{"best"} }, true},
+		{"just launched", func(r *runEntry) { r.Manifest.StartedAt = now.Add(-time.Minute) }, true},
+		{"just modified", func(r *runEntry) { r.ModifiedAt = now.Add(-time.Minute) }, true},
+		{"exited", func(r *runEntry) { r.Status, r.Manifest.FinishedAt = runStatusExited, nil }, false},
+		{"exited on another host", func(r *runEntry) {
+			r.Status, r.Manifest.FinishedAt, r.Manifest.Host.Hostname = runStatusExited, nil, "node2"
+		}, true},
+		{"exited through an endpoint", func(r *runEntry) {
+			r.Status, r.Manifest.FinishedAt, r.Manifest.Endpoint = runStatusExited, nil, "ssh://node1"
+		}, true},
+		{"exited on several hosts", func(r *runEntry) {
+			r.Status, r.Manifest.FinishedAt, r.Manifest.Args.Hosts = runStatusExited, nil, []string{"node1", "node2"}
+		}, true},
+		{"finished on another host", func(r *runEntry) { r.Manifest.Host.Hostname = "node2" }, false},
+	}
+
+	policy := prunePolicy{KeepTagged: true, Grace: time.Hour, Hostname: "node1"}
+	for _, tt := range tests {
+		r := local(runStatusCompleted)
+		tt.run(&r)
+		if got := policy.protected(r, now); got != tt.protected {
+			t.Errorf("%s: protected = %t, want %t", tt.name, got, tt.protected)
+		}
+	}
+}
+
+func TestSelectPrunableSkipsProtected(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	var runs []runEntry
+	for i, status := range []string{runStatusCompleted, runStatusUnknown, runStatusFailed} {
+		started := now.Add(-time.Duration(72-i) * time.Hour)
+		var manifest *RunManifest
+		if status != runStatusUnknown {
+			manifest = &RunManifest{Status: status, Host: ManifestHost{Hostname: "node1"}, StartedAt: started, FinishedAt: &started}
+		}
+		runs = append(runs, runEntry{Project: "p", Experiment: "e", Run: status, Path: status, Status: status, ModifiedAt: started, Size: 10, Manifest: manifest})
+	}
+
+	policy := prunePolicy{MaxTotalSize: 1, Grace: time.Hour, Hostname: "node1"}
+	decisions := policy.selectPrunable(runs, now)
+	if len(decisions) != 2 || decisions[0].Run.Run != runStatusCompleted || decisions[1].Run.Run != runStatusFailed {
+		t.Errorf("decisions = %+v, want the completed and the failed run", decisions)
+	}
+}
@@ -0,0 +1,705 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusStarting  = "starting"
+	jobStatusStarted   = "started"
+	jobStatusFailed    = "failed"
+	jobStatusCancelled = "cancelled"
+
+	// finished jobs are dropped from the queue after queueJobRetention
+	queueJobRetention = 7 * 24 * time.Hour
+)
+
+// queueJob is an experiment run waiting for the resources it needs on this
+// host.
+type queueJob struct {
+	ID       int     `json:"id"`
+	Priority int     `json:"priority"`
+	Status   string  `json:"status"`
+	Args     RunArgs `json:"args"`
+	// UID is the user who queued the job, only a worker of the same user
+	// starts it.
+	UID int `json:"uid"`
+	// Dir is the project directory the run was queued from.
+	Dir        string     `json:"dir"`
+	EnqueuedAt time.Time  `json:"enqueued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Waiting is what the worker last saw the job wait for.
+	Waiting string `json:"waiting,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkOwner refuses a job that was not queued by uid from a directory of
+// uid, the worker would launch it with its own rights.
+func (j queueJob) checkOwner(uid int) error {
+	if j.UID != uid {
+		return errors.Errorf("job %d was queued by uid %d, the worker runs as uid %d", j.ID, j.UID, uid)
+	}
+
+	info, err := os.Lstat(j.Dir)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to stat directory %s of job %d", j.Dir, j.ID)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s of job %d is not a directory", j.Dir, j.ID)
+	}
+	owner, err := fileOwner(j.Dir, info)
+	if err != nil {
+		return err
+	}
+	if owner != uid {
+		return errors.Errorf("directory %s of job %d is owned by uid %d, not by uid %d", j.Dir, j.ID, owner, uid)
+	}
+
+	return nil
+}
+
+func (j queueJob) finished() bool {
+	return j.Status == jobStatusStarted || j.Status == jobStatusFailed || j.Status == jobStatusCancelled
+}
+
+type jobQueue struct {
+	path       string
+	lockPath   string
+	workerLock string
+}
+
+func newJobQueue(layout *Layout) *jobQueue {
+	return &jobQueue{
+		path:       filepath.Join(layout.StateDir(), "queue.json"),
+		lockPath:   filepath.Join(layout.StateDir(), "queue.lock"),
+		workerLock: filepath.Join(layout.StateDir(), fmt.Sprintf("queue.worker.%d.lock", os.Getuid())),
+	}
+}
+
+func (q *jobQueue) load() ([]queueJob, error) {
+	content, err := readStateFile(q.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", q.path)
+	}
+
+	var jobs []queueJob
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse %s", q.path)
+	}
+
+	return jobs, nil
+}
+
+func (q *jobQueue) save(jobs []queueJob) error {
+	content, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode job queue")
+	}
+
+	return writeFileAtomic(q.path, content, 0o644, true)
+}
+
+// update loads the jobs under the lock, hands them to fn and stores whatever
+// fn returns. Jobs that finished long ago are dropped.
+func (q *jobQueue) update(fn func(jobs []queueJob) ([]queueJob, error)) error {
+	return withFileLock(q.lockPath, func() error {
+		jobs, err := q.load()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		kept := make([]queueJob, 0, len(jobs))
+		for _, j := range jobs {
+			if !j.finished() || j.FinishedAt == nil || now.Sub(*j.FinishedAt) < queueJobRetention {
+				kept = append(kept, j)
+			}
+		}
+
+		updated, err := fn(kept)
+		if err != nil {
+			return err
+		}
+
+		return q.save(updated)
+	})
+}
+
+func (q *jobQueue) jobs() ([]queueJob, error) {
+	var jobs []queueJob
+	err := q.update(func(current []queueJob) ([]queueJob, error) {
+		jobs = current
+		return current, nil
+	})
+
+	return jobs, err
+}
+
+// setJob lets fn change the job with the given id, nothing is stored if fn
+// fails.
+func (q *jobQueue) setJob(id int, fn func(j *queueJob) error) error {
+	return q.update(func(jobs []queueJob) ([]queueJob, error) {
+		for i := range jobs {
+			if jobs[i].ID == id {
+				return jobs, fn(&jobs[i])
+			}
+		}
+		return nil, errors.Errorf("job %d is not in the queue", id)
+	})
+}
+
+// nextJob returns the queued job to start next: highest priority first,
+// then in the order they were queued.
+func nextJob(jobs []queueJob) (queueJob, bool) {
+	var queued []queueJob
+	for _, j := range jobs {
+		if j.Status == jobStatusQueued {
+			queued = append(queued, j)
+		}
+	}
+	if len(queued) == 0 {
+		return queueJob{}, false
+	}
+
+	sort.SliceStable(queued, func(i, k int) bool {
+		if queued[i].Priority != queued[k].Priority {
+			return queued[i].Priority > queued[k].Priority
+		}
+		return queued[i].ID < queued[k].ID
+	})
+
+	return queued[0], true
+}
+
+// enqueue adds a job of uid queued from dir.
+func (q *jobQueue) enqueue(runArgs RunArgs, priority, uid int, dir string) (queueJob, error) {
+	var job queueJob
+	err := q.update(func(jobs []queueJob) ([]queueJob, error) {
+		id := 1
+		for _, j := range jobs {
+			id = max(id, j.ID+1)
+		}
+
+		job = queueJob{
+			ID:         id,
+			Priority:   priority,
+			Status:     jobStatusQueued,
+			Args:       runArgs,
+			UID:        uid,
+			Dir:        dir,
+			EnqueuedAt: time.Now(),
+		}
+		return append(jobs, job), nil
+	})
+
+	return job, err
+}
+
+type EnqueueArgs struct {
+	Run      RunArgs
+	Priority int
+}
+
+// Enqueue adds an experiment run to the queue of this host instead of
+// launching it, queue worker starts it once its resources are free.
+func Enqueue(args EnqueueArgs) {
+	runArgs := args.Run
+
+	layout, err := NewLayout(runArgs.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// every host has to queue the run under the same name
+	if runArgs.RunName == "" {
+		if runArgs.RunName, err = generateRunName(runArgs.ExperimentName, runArgs.RunNameStyle, runArgs.RunNonce, len(runArgs.Hosts) > 1, runNameTaken(layout, runArgs.ProjectName, runArgs.ExperimentName)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printGeneratedRunName(runArgs.RunName)
+	}
+
+	// the port may still be derived when the job starts
+	if err := Validator().StructExcept(runArgs, "Port"); err != nil {
+		panic(err)
+	}
+
+	if _, err := parseGPUs(runArgs.GPUs); err != nil {
+		fmt.Printf("invalid --gpus: %v\n", err)
+		os.Exit(1)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("failed to get current working directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	job, err := newJobQueue(layout).enqueue(runArgs, args.Priority, os.Getuid(), cwd)
+	if err != nil {
+		fmt.Printf("failed to queue the run: %v\n", err)
+		os.Exit(1)
+	}
+
+	position := 0
+	if jobs, err := newJobQueue(layout).jobs(); err == nil {
+		for _, j := range jobs {
+			if j.Status == jobStatusQueued && j.ID != job.ID && (j.Priority > job.Priority || (j.Priority == job.Priority && j.ID < job.ID)) {
+				position++
+			}
+		}
+	}
+
+	fmt.Printf("queued run %s of experiment %s as job %d, %d jobs ahead of it\n", runArgs.RunName, runArgs.ExperimentName, job.ID, position)
+}
+
+type QueueWorkerArgs struct {
+	// Poll is the number of seconds between looks at the queue.
+	Poll     int `validate:"min=1"`
+	Once     bool
+	CacheDir string
+}
+
+type queueWorker struct {
+	args QueueWorkerArgs
+	// uid the worker runs as, it only starts jobs of that user
+	uid        int
+	queue      *jobQueue
+	leases     *portLeases
+	dr         *DockerRun
+	executable string
+	output     sync.Mutex
+}
+
+// waitingFor tells what keeps the job from starting, empty if nothing does.
+func (w *queueWorker) waitingFor(job queueJob) (string, error) {
+	containerName := nameFromRunArgs(job.Args)
+
+	running, err := runningContainerNames(context.Background())
+	if err != nil {
+		return "", err
+	}
+	// starting the job would replace the container
+	if running[containerName] {
+		return fmt.Sprintf("container %s is running", containerName), nil
+	}
+
+	if port := job.Args.Port; port != 0 {
+		taken, err := w.leases.taken()
+		if err != nil {
+			return "", err
+		}
+		if holder, ok := taken[port]; ok && holder != containerName {
+			return fmt.Sprintf("port %d is leased", port), nil
+		}
+
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Sprintf("port %d is in use", port), nil
+		}
+		listener.Close()
+	}
+
+	request, err := parseGPUs(job.Args.GPUs)
+	if err != nil {
+		return "", err
+	}
+	accelerator, err := detectAccelerator(w.dr.devRoot, job.Args.Accelerator)
+	if err != nil {
+		return "", err
+	}
+	claimed, err := w.dr.claimedGPUs(accelerator)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case request.Auto > 0:
+		free := 0
+		for _, index := range accelerator.Indices(w.dr.devRoot) {
+			if _, ok := claimed[index]; !ok {
+				free++
+			}
+		}
+		if free < request.Auto {
+			return fmt.Sprintf("%d of %d gpus free", free, request.Auto), nil
+		}
+	case request.Indices != nil:
+		for _, index := range request.Indices {
+			if holder, ok := claimed[index]; ok {
+				return fmt.Sprintf("gpu %d is used by %s", index, holder), nil
+			}
+		}
+	default:
+		holders := map[string]bool{}
+		for _, holder := range claimed {
+			holders[holder] = true
+		}
+		if len(holders) > 0 {
+			names := make([]string, 0, len(holders))
+			for name := range holders {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Sprintf("all gpus wanted, used by %s", strings.Join(names, ", ")), nil
+		}
+	}
+
+	return "", nil
+}
+
+// startNext starts the next job if its resources are free, started tells
+// whether it tried.
+// claimNext marks the job to start next as starting and returns it, a zero
+// job if none can start. Jobs of other users are left to their own workers,
+// those queued from a directory the user does not own are marked failed.
+func (w *queueWorker) claimNext() (queueJob, error) {
+	var job queueJob
+	err := w.queue.update(func(jobs []queueJob) ([]queueJob, error) {
+		own := func() (queueJob, bool) {
+			mine := make([]queueJob, 0, len(jobs))
+			for _, j := range jobs {
+				if j.UID == w.uid {
+					mine = append(mine, j)
+				}
+			}
+			return nextJob(mine)
+		}
+
+		next, ok := own()
+		for ok {
+			err := next.checkOwner(w.uid)
+			if err == nil {
+				break
+			}
+
+			fmt.Printf("refusing job %d: %v\n", next.ID, err)
+			for i := range jobs {
+				if jobs[i].ID == next.ID {
+					now := time.Now()
+					jobs[i].Status, jobs[i].Error, jobs[i].FinishedAt = jobStatusFailed, err.Error(), &now
+				}
+			}
+			next, ok = own()
+		}
+		if !ok {
+			return jobs, nil
+		}
+
+		waiting, err := w.waitingFor(next)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range jobs {
+			if jobs[i].ID != next.ID {
+				continue
+			}
+
+			if waiting != "" {
+				if jobs[i].Waiting != waiting {
+					fmt.Printf("job %d waits: %s\n", next.ID, waiting)
+				}
+				jobs[i].Waiting = waiting
+				break
+			}
+
+			now := time.Now()
+			jobs[i].Status, jobs[i].Waiting, jobs[i].StartedAt = jobStatusStarting, "", &now
+			job = jobs[i]
+		}
+
+		return jobs, nil
+	})
+
+	return job, err
+}
+
+func (w *queueWorker) startNext() (started bool, err error) {
+	job, err := w.claimNext()
+	if err != nil || job.ID == 0 {
+		return false, err
+	}
+
+	fmt.Printf("starting job %d, run %s of experiment %s\n", job.ID, job.Args.RunName, job.Args.ExperimentName)
+
+	out := newPrefixWriter(&w.output, os.Stdout, fmt.Sprintf("[job %d] ", job.ID))
+	cmdArgs := []string{"queue", "exec", "--id", fmt.Sprint(job.ID)}
+	if w.args.CacheDir != "" {
+		cmdArgs = append(cmdArgs, "--cache_dir", w.args.CacheDir)
+	}
+	cmd := exec.Command(w.executable, cmdArgs...)
+	cmd.Dir = job.Dir
+	cmd.Stdout, cmd.Stderr = out, out
+
+	runErr := cmd.Run()
+	out.Flush()
+
+	err = w.queue.setJob(job.ID, func(j *queueJob) error {
+		now := time.Now()
+		j.FinishedAt = &now
+		if runErr != nil {
+			j.Status, j.Error = jobStatusFailed, runErr.Error()
+		} else {
+			j.Status = jobStatusStarted
+		}
+		return nil
+	})
+
+	if runErr != nil {
+		fmt.Printf("job %d failed to start: %v\n", job.ID, runErr)
+	} else {
+		fmt.Printf("job %d started\n", job.ID)
+	}
+
+	return true, err
+}
+
+// QueueWorker starts the queued jobs of this host one after the other, each
+// once the gpus, port and container name it needs are free. Only one worker
+// runs per host.
+func QueueWorker(args QueueWorkerArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	w := &queueWorker{args: args, uid: os.Getuid(), queue: newJobQueue(layout), leases: newPortLeases(layout)}
+
+	release, held, err := tryFileLock(w.queue.workerLock)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	} else if !held {
+		fmt.Println("another queue worker of this user is running on this host")
+		os.Exit(1)
+	}
+	defer release()
+
+	if w.executable, err = os.Executable(); err != nil {
+		fmt.Printf("failed to find the invoker executable: %v\n", err)
+		os.Exit(1)
+	}
+
+	if w.dr, err = NewDockerRun(context.Background(), "", "", layout, DockerEndpoint{}); err != nil {
+		panic(err)
+	}
+
+	// a job left starting belonged to a worker that died on it
+	err = w.queue.update(func(jobs []queueJob) ([]queueJob, error) {
+		for i := range jobs {
+			if jobs[i].Status == jobStatusStarting {
+				now := time.Now()
+				jobs[i].Status, jobs[i].Error, jobs[i].FinishedAt = jobStatusFailed, "the queue worker exited while starting it", &now
+			}
+		}
+		return jobs, nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	poll := time.Duration(args.Poll) * time.Second
+	fmt.Printf("queue worker started, looking at the queue every %s\n", poll)
+
+	for {
+		started, err := w.startNext()
+		if err != nil {
+			fmt.Printf("failed to start the next job: %v\n", err)
+		}
+		if started {
+			continue
+		}
+
+		if args.Once {
+			return
+		}
+		time.Sleep(poll)
+	}
+}
+
+type QueueExecArgs struct {
+	ID       int `validate:"min=1"`
+	CacheDir string
+}
+
+// QueueExec launches a job the worker picked, in a process of its own as a
+// failing launch exits.
+func QueueExec(args QueueExecArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var job queueJob
+	err = newJobQueue(layout).setJob(args.ID, func(j *queueJob) error {
+		if j.Status != jobStatusStarting {
+			return errors.Errorf("job %d is %s, only the queue worker starts jobs", j.ID, j.Status)
+		}
+		if err := j.checkOwner(os.Getuid()); err != nil {
+			return err
+		}
+		job = *j
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	Run(job.Args)
+}
+
+type QueueListArgs struct {
+	All      bool
+	JSON     bool
+	CacheDir string
+}
+
+func QueueList(args QueueListArgs) {
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	jobs, err := newJobQueue(layout).jobs()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	shown := make([]queueJob, 0, len(jobs))
+	for _, j := range jobs {
+		if args.All || !j.finished() {
+			shown = append(shown, j)
+		}
+	}
+
+	// in the order the worker takes them
+	rank := func(j queueJob) int {
+		switch j.Status {
+		case jobStatusStarting:
+			return 0
+		case jobStatusQueued:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(shown, func(i, k int) bool {
+		a, b := shown[i], shown[k]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Status == jobStatusQueued && a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.ID < b.ID
+	})
+
+	if args.JSON {
+		printJSON(shown)
+		return
+	}
+
+	if len(shown) == 0 {
+		fmt.Println("the queue is empty")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tPRIORITY\tSTATUS\tPROJECT\tEXPERIMENT\tRUN\tGPUS\tQUEUED\tNOTE\n")
+	for _, j := range shown {
+		gpus := j.Args.GPUs
+		if gpus == "" {
+			gpus = gpuLabelAll
+		}
+		note := j.Waiting
+		if j.Error != "" {
+			note = j.Error
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			j.ID, j.Priority, j.Status, j.Args.ProjectName, j.Args.ExperimentName, j.Args.RunName, gpus, formatModified(j.EnqueuedAt), note)
+	}
+	w.Flush()
+}
+
+type QueueCancelArgs struct {
+	IDs      []string
+	CacheDir string
+}
+
+// QueueCancel takes queued jobs off the queue, started runs are stopped with
+// experiment kill.
+func QueueCancel(args QueueCancelArgs) {
+	if len(args.IDs) == 0 {
+		fmt.Println("no job ids given")
+		os.Exit(1)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, arg := range args.IDs {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Printf("invalid job id %q\n", arg)
+			failed = true
+			continue
+		}
+
+		err = newJobQueue(layout).setJob(id, func(j *queueJob) error {
+			if j.Status != jobStatusQueued {
+				return errors.Errorf("job %d is %s, only queued jobs can be cancelled", id, j.Status)
+			}
+			now := time.Now()
+			j.Status, j.Waiting, j.FinishedAt = jobStatusCancelled, "", &now
+			return nil
+		})
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Printf("cancelled job %d\n", id)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestQueue(t *testing.T) *jobQueue {
+	t.Helper()
+
+	t.Setenv(stateDirEnv, t.TempDir())
+	layout, err := NewLayout(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newJobQueue(layout)
+}
+
+func TestQueueWorkerRefusesJobsOfOtherUsers(t *testing.T) {
+	queue := newTestQueue(t)
+	uid := os.Getuid()
+
+	job, err := queue.enqueue(RunArgs{ProjectName: "proj", ExperimentName: "exp"}, 0, uid+1, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &queueWorker{uid: uid, queue: queue}
+	next, err := w.claimNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != 0 {
+		t.Fatalf("worker of uid %d claimed job %d of uid %d", uid, next.ID, uid+1)
+	}
+
+	jobs, err := queue.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].Status != jobStatusQueued {
+		t.Errorf("jobs = %+v, want the job left queued for its own worker", jobs)
+	}
+}
+
+func TestQueueWorkerFailsJobsFromForeignDirs(t *testing.T) {
+	queue := newTestQueue(t)
+	uid := os.Getuid()
+
+	dir := t.TempDir()
+	if err := os.Chown(dir, uid+1, -1); err != nil {
+		t.Skipf("can not hand the directory to another user: %v", err)
+	}
+	if _, err := queue.enqueue(RunArgs{ProjectName: "proj", ExperimentName: "exp"}, 0, uid, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &queueWorker{uid: uid, queue: queue}
+	if next, err := w.claimNext(); err != nil || next.ID != 0 {
+		t.Fatalf("claimNext() = job %d, %v, want none", next.ID, err)
+	}
+
+	jobs, err := queue.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Status != jobStatusFailed || !strings.Contains(jobs[0].Error, "owned by uid") {
+		t.Errorf("jobs = %+v, want the job failed for its directory", jobs)
+	}
+}
+
+func TestQueueJobCheckOwner(t *testing.T) {
+	uid := os.Getuid()
+	dir := t.TempDir()
+
+	if err := (queueJob{ID: 1, UID: uid, Dir: dir}).checkOwner(uid); err != nil {
+		t.Errorf("own job refused: %v", err)
+	}
+	if err := (queueJob{ID: 1, UID: uid + 1, Dir: dir}).checkOwner(uid); err == nil {
+		t.Error("job of another uid accepted")
+	}
+
+	if err := os.Chown(dir, uid+1, -1); err != nil {
+		t.Skipf("can not hand the directory to another user: %v", err)
+	}
+	if err := (queueJob{ID: 1, UID: uid, Dir: dir}).checkOwner(uid); err == nil {
+		t.Error("job from a directory of another uid accepted")
+	}
+}
@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+type EndpointRunArgs struct {
+	Run       RunArgs
+	Endpoints DockerEndpoints
+	// RemoteDir is the project directory on the hosts, the local one if
+	// empty. It has to be shared with this machine.
+	RemoteDir string
+	// Wait follows the output of the ranks until they exit.
+	Wait bool
+}
+
+// RunOnEndpoints launches every rank of the run from this machine through
+// the docker daemon of its host. Ranks follow the order of --hosts, every
+// daemon builds the image from the local project.
+func RunOnEndpoints(args EndpointRunArgs) {
+	runArgs := args.Run
+	if err := args.Endpoints.check(runArgs.Hosts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if runArgs.Rank != nil {
+		fmt.Println("--rank does not go with --docker_endpoint, ranks follow the order of --hosts")
+		os.Exit(1)
+	}
+
+	layout, err := NewLayout(runArgs.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// decided here once, so the hosts need no nonce
+	if runArgs.RunName == "" {
+		if runArgs.RunName, err = generateRunName(runArgs.ExperimentName, runArgs.RunNameStyle, runArgs.RunNonce, false, runNameTaken(layout, runArgs.ProjectName, runArgs.ExperimentName)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printGeneratedRunName(runArgs.RunName)
+	}
+
+	if runArgs.Port == 0 {
+		r, err := ParsePortRange(runArgs.PortRange)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		runArgs.Port = hashedPort(r, runArgs.ProjectName, runArgs.ExperimentName, runArgs.RunName)
+		fmt.Printf("derived port %d from the run identity\n", runArgs.Port)
+	}
+
+	if err := Validator().Struct(runArgs); err != nil {
+		panic(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("failed to get current working directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	gitState := projectGitState(cwd, runArgs.RequireClean)
+
+	customProfiles, err := loadCustomHostProfiles(hostProfileDirs())
+	if err != nil {
+		fmt.Printf("failed to load host profiles: %v\n", err)
+		os.Exit(1)
+	}
+
+	// detection looks at the host itself, remote ones get the fallback
+	profileName := runArgs.HostProfile
+	if profileName == "" || profileName == "auto" {
+		profileName = "bare-metal"
+	}
+	profile, err := selectHostProfile(devRoot(), profileName, customProfiles)
+	if err != nil {
+		fmt.Printf("invalid --host_profile: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("using host profile %s\n", profile.Name)
+
+	gpus, err := parseGPUs(runArgs.GPUs)
+	if err == nil && gpus.Auto > 0 {
+		err = errors.Errorf("auto:%d needs the gpus of the host, pass indices or all with --docker_endpoint", gpus.Auto)
+	}
+	if err != nil {
+		fmt.Printf("invalid --gpus: %v\n", err)
+		os.Exit(1)
+	}
+
+	if n := gpus.count(); n != -1 && runArgs.NProcPerNode > n {
+		fmt.Printf("--nproc_per_node=%d but only %d gpus are assigned\n", runArgs.NProcPerNode, n)
+		os.Exit(1)
+	}
+
+	mounts, resources, security := resolveContainerOptions(cwd, runArgs)
+	if resources.NUMAPinned {
+		fmt.Println("--cpu_pinning=numa needs the topology of the host, pass --cpuset with --docker_endpoint")
+		os.Exit(1)
+	}
+
+	if err := writeRunScript(); err != nil {
+		fmt.Printf("failed to create a file: %v\n", err)
+	}
+
+	containerName := nameFromRunArgs(runArgs)
+	checkpointDir := layout.RunDir(runArgs.ProjectName, runArgs.ExperimentName, runArgs.RunName)
+	if err := layout.MakeRunDirs(runArgs.ProjectName, runArgs.ExperimentName, runArgs.RunName); err != nil {
+		fmt.Printf("failed to create directories: %v\n", err)
+		os.Exit(1)
+	}
+	saveGitPatch(layout, runArgs, cwd, gitState)
+	printTrainingInfo(runArgs, containerName, checkpointDir)
+
+	projectDir := args.RemoteDir
+	if projectDir == "" {
+		projectDir = cwd
+	}
+
+	master := runArgs.Hosts[0]
+	if len(runArgs.Hosts) == 1 {
+		master = "localhost"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the containers bind the project directory and the cache of this
+	// machine, which every host has to share, checked before any launch
+	marker := filepath.Join(layout.RunMetadataDir(runArgs.ProjectName, runArgs.ExperimentName, runArgs.RunName), "endpoint-check")
+	nonce := []byte(fmt.Sprintf("%d-%d\n", os.Getpid(), time.Now().UnixNano()))
+	if err := writeFileAtomic(marker, nonce, 0o644, true); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	drs := make([]*DockerRun, len(runArgs.Hosts))
+	checks := make([]hostResult, 0, len(runArgs.Hosts))
+	shared := true
+	for rank, host := range runArgs.Hosts {
+		endpoint := args.Endpoints.forHost(host)
+		fmt.Printf("checking that %s shares %s and %s, through %s\n", host, projectDir, layout.CacheRoot(), endpoint)
+
+		start := time.Now()
+		dr, err := NewDockerRun(ctx, runArgs.ProjectName, cwd, layout, endpoint)
+		if err == nil {
+			err = dr.checkSharedPaths(projectDir, marker, nonce)
+		}
+		drs[rank] = dr
+		checks = append(checks, hostResult{Host: host, Rank: rank, Err: err, Elapsed: time.Since(start)})
+		shared = shared && err == nil
+	}
+	os.Remove(marker)
+
+	if !shared {
+		fmt.Println()
+		printHostResults(checks)
+		fmt.Println("--docker_endpoint needs the project directory and the cache shared with every host at the same paths, e.g. over nfs, pass --remote_dir and --cache_dir if they are elsewhere")
+		os.Exit(1)
+	}
+
+	manifestPath := layout.RunManifestPath(runArgs.ProjectName, runArgs.ExperimentName, runArgs.RunName)
+	results := make([]hostResult, 0, len(runArgs.Hosts))
+	launched := make([]*DockerRun, 0, len(runArgs.Hosts))
+	failed := false
+
+	// one host after the other, so a broken host stops the launch before
+	// the others wait for it
+	for rank, host := range runArgs.Hosts {
+		endpoint := args.Endpoints.forHost(host)
+		fmt.Printf("\nlaunching rank %d on %s through %s\n", rank, host, endpoint)
+
+		cmd, cmdArgs := buildArgs(
+			len(runArgs.Hosts),
+			rank,
+			master,
+			runArgs.Port,
+			[]string{"hf.py", "run"},
+			runArgs.NProcPerNode,
+			runArgs.ExperimentName,
+			runArgs.RunName,
+			runArgs.MaxRepeats,
+			runArgs.Rest,
+		)
+
+		start := time.Now()
+		manifest := &RunManifest{
+			Project:       runArgs.ProjectName,
+			Experiment:    runArgs.ExperimentName,
+			Run:           runArgs.RunName,
+			Args:          runArgs,
+			Rank:          rank,
+			Master:        master,
+			Port:          runArgs.Port,
+			Command:       append([]string{cmd}, cmdArgs...),
+			Host:          ManifestHost{Hostname: host, Address: host},
+			Endpoint:      endpoint.Host,
+			ContainerName: containerName,
+			Image:         ManifestImage{Tag: imageTag},
+			Git:           gitState,
+			StartedAt:     start,
+		}
+
+		dr := drs[rank]
+		accelerator, err := dr.remoteAccelerator(runArgs.Accelerator)
+		if err == nil {
+			manifest.Accelerator = accelerator.Name()
+			err = dr.launchRank(manifest, containerName, RunOptions{
+				Profile:     profile,
+				Accelerator: accelerator,
+				GPUs:        gpus,
+				Mounts:      mounts,
+				Resources:   resources,
+				Security:    security,
+				Labels: map[string]string{
+					labelProject:    runArgs.ProjectName,
+					labelExperiment: runArgs.ExperimentName,
+					labelRun:        runArgs.RunName,
+				},
+				Git:          gitState,
+				Image:        runArgs.Image,
+				ProjectDir:   projectDir,
+				SharedCaches: !runArgs.IsolateCaches,
+			})
+		}
+
+		// the run directory is shared by all hosts, it records the launch
+		// of rank 0
+		if rank == 0 {
+			if err != nil {
+				manifest.Status, manifest.Error = runStatusFailed, err.Error()
+			}
+			if err := manifest.save(manifestPath); err != nil {
+				fmt.Printf("failed to write run manifest: %v\n", err)
+			}
+		}
+
+		results = append(results, hostResult{Host: host, Rank: rank, Err: err, Elapsed: time.Since(start)})
+		if err != nil {
+			failed = true
+			break
+		}
+		launched = append(launched, dr)
+	}
+
+	// the ranks that are up would wait for the missing ones until torchrun
+	// gives up, take them down right away
+	if failed && len(launched) > 0 {
+		fmt.Printf("\nremoving the %d ranks already started\n", len(launched))
+		for _, dr := range launched {
+			dr.ctx = context.Background()
+			if err := dr.Kill(containerName); err != nil {
+				fmt.Printf("failed to kill %s through %s: %v\n", containerName, dr.endpoint, err)
+			}
+		}
+	}
+
+	fmt.Println()
+	if !printHostResults(results) {
+		os.Exit(1)
+	}
+
+	if args.Wait {
+		fmt.Printf("\nfollowing the %d ranks until they exit, interrupt to leave them running\n", len(launched))
+		results = superviseRanks(runArgs.Hosts, launched, containerName, manifestPath)
+
+		fmt.Println()
+		if !printHostResults(results) {
+			os.Exit(1)
+		}
+	}
+}
+
+// superviseRanks follows the output of the ranks, prefixed with their host,
+// until their containers exit, and records the exit codes of all ranks in
+// the run manifest.
+func superviseRanks(hosts []string, launched []*DockerRun, containerName, manifestPath string) []hostResult {
+	results := make([]hostResult, len(launched))
+	exitCodes := make([]*int, len(launched))
+
+	var output sync.Mutex
+	var wg sync.WaitGroup
+	for rank, dr := range launched {
+		wg.Add(1)
+		go func(rank int, dr *DockerRun) {
+			defer wg.Done()
+
+			start := time.Now()
+			out := newPrefixWriter(&output, os.Stdout, "["+hosts[rank]+"] ")
+			exitCode, err := dr.supervise(containerName, out)
+			out.Flush()
+
+			exitCodes[rank] = exitCode
+			results[rank] = hostResult{Host: hosts[rank], Rank: rank, Err: err, Elapsed: time.Since(start)}
+		}(rank, dr)
+	}
+	wg.Wait()
+
+	if manifest, err := loadRunManifest(manifestPath); err == nil {
+		manifest.RankExitCodes = exitCodes
+		if err := manifest.save(manifestPath); err != nil {
+			fmt.Printf("failed to write run manifest: %v\n", err)
+		}
+	} else {
+		fmt.Println(err)
+	}
+
+	return results
+}
+
+// supervise copies the output of the container to out until it exits and
+// returns its exit code, nil if it is still running when d.ctx is done.
+func (d *DockerRun) supervise(containerName string, out io.Writer) (*int, error) {
+	logs, err := d.client.ContainerLogs(d.ctx, containerName, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to follow the output of %s", containerName)
+	}
+	defer logs.Close()
+
+	// following ends with the container, the connection may end earlier
+	if _, err := stdcopy.StdCopy(out, out, logs); err != nil && d.ctx.Err() == nil {
+		fmt.Printf("lost the output of %s through %s: %v\n", containerName, d.endpoint, err)
+	}
+
+	statusCh, errCh := d.client.ContainerWait(d.ctx, containerName, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if d.ctx.Err() != nil {
+			return nil, errors.New("interrupted, the container keeps running")
+		}
+		return nil, errors.WithMessage(err, "failed to wait for the container")
+	case <-statusCh:
+	}
+
+	info, err := d.Inspect(containerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.finalizeRunManifest(info, false); err != nil {
+		fmt.Printf("failed to update run manifest: %v\n", err)
+	}
+
+	if info.State.ExitCode != 0 {
+		return PtrTo(info.State.ExitCode), errors.Errorf("exited with code %d", info.State.ExitCode)
+	}
+
+	return PtrTo(0), nil
+}
+
+// launchRank starts the container of one rank and fills in the manifest.
+func (d *DockerRun) launchRank(manifest *RunManifest, containerName string, opts RunOptions) error {
+	if opts.Accelerator.Name() != (noneProvider{}).Name() && !opts.Profile.DeviceRequests {
+		return errors.Errorf("host profile %s maps devices directly, which needs invoker on the host", opts.Profile.Name)
+	}
+
+	info, err := d.Run(containerName, manifest.Command[0], manifest.Command[1:], manifest.Port, opts)
+	if err != nil {
+		return err
+	}
+
+	manifest.started(info, d.imageDigests(info.Image))
+	return nil
+}
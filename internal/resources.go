@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const cpuPinningNUMA = "numa"
+
+// rankCPUsEnv holds the cpu list of every local rank, separated by ";", the
+// run script pins the rank of $LOCAL_RANK to its list.
+const rankCPUsEnv = "INVOKER_RANK_CPUS"
+
+// ResourceSpec limits what a run may use on the host, so several runs can
+// share one machine. Empty fields keep the defaults.
+type ResourceSpec struct {
+	// ShmSize sizes /dev/shm, only used when IPC is not host, e.g. 32g.
+	ShmSize string `json:"shm_size,omitempty"`
+	// CPUSet is a cpu list like 0-15,32-47.
+	CPUSet string `json:"cpuset,omitempty"`
+	// CPUPinning set to numa pins every local rank to the CPUs local to its
+	// accelerator, the container to the union of them. It cannot be
+	// combined with CPUSet.
+	CPUPinning string `json:"cpu_pinning,omitempty"`
+	Memory     string `json:"memory,omitempty"`
+	// Ulimits are name=soft[:hard] and override the defaults by name.
+	Ulimits []string `json:"ulimits,omitempty"`
+	// IPC is host (the default), private or shareable.
+	IPC string `json:"ipc,omitempty"`
+}
+
+// defaultUlimits are what every run used to get unconditionally.
+func defaultUlimits() []*units.Ulimit {
+	return []*units.Ulimit{
+		{
+			Name: "memlock",
+			Soft: -1,
+			Hard: -1,
+		},
+		{
+			Name: "stack",
+			Soft: 67108864,
+			Hard: 67108864,
+		},
+	}
+}
+
+type containerResources struct {
+	IPC        container.IpcMode
+	ShmSize    int64
+	Memory     int64
+	CPUSet     string
+	NUMAPinned bool
+	Ulimits    []*units.Ulimit
+}
+
+// resolveResources merges the project config with the command line, the
+// latter winning field by field.
+func resolveResources(config, flags ResourceSpec) (containerResources, error) {
+	spec := config
+	for _, f := range []struct{ dst, src *string }{
+		{&spec.ShmSize, &flags.ShmSize},
+		{&spec.CPUSet, &flags.CPUSet},
+		{&spec.CPUPinning, &flags.CPUPinning},
+		{&spec.Memory, &flags.Memory},
+		{&spec.IPC, &flags.IPC},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	spec.Ulimits = append(append([]string{}, config.Ulimits...), flags.Ulimits...)
+
+	resources := containerResources{IPC: container.IPCModeHost}
+
+	switch spec.IPC {
+	case "", "host":
+	case "private", "shareable":
+		resources.IPC = container.IpcMode(spec.IPC)
+	default:
+		return resources, errors.Errorf("invalid ipc mode %q, expected host, private or shareable", spec.IPC)
+	}
+
+	if spec.ShmSize != "" {
+		if resources.IPC.IsHost() {
+			return resources, errors.New("shm size has no effect with the host ipc namespace, set ipc to private")
+		}
+
+		size, err := units.RAMInBytes(spec.ShmSize)
+		if err != nil {
+			return resources, errors.WithMessage(err, "invalid shm size")
+		}
+		resources.ShmSize = size
+	}
+
+	if spec.Memory != "" {
+		memory, err := units.RAMInBytes(spec.Memory)
+		if err != nil {
+			return resources, errors.WithMessage(err, "invalid memory limit")
+		}
+		resources.Memory = memory
+	}
+
+	switch spec.CPUPinning {
+	case "", "none":
+	case cpuPinningNUMA:
+		if spec.CPUSet != "" {
+			return resources, errors.New("cpuset and numa cpu pinning cannot be combined")
+		}
+		resources.NUMAPinned = true
+	default:
+		return resources, errors.Errorf("invalid cpu pinning %q, expected none or numa", spec.CPUPinning)
+	}
+
+	if spec.CPUSet != "" {
+		cpus, err := parseCPUList(spec.CPUSet)
+		if err != nil {
+			return resources, errors.WithMessage(err, "invalid cpuset")
+		}
+		resources.CPUSet = formatCPUList(cpus)
+	}
+
+	resources.Ulimits = defaultUlimits()
+	for _, value := range spec.Ulimits {
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return resources, errors.WithMessagef(err, "invalid ulimit %q", value)
+		}
+
+		replaced := false
+		for i, u := range resources.Ulimits {
+			if u.Name == ulimit.Name {
+				resources.Ulimits[i], replaced = ulimit, true
+			}
+		}
+		if !replaced {
+			resources.Ulimits = append(resources.Ulimits, ulimit)
+		}
+	}
+
+	return resources, nil
+}
+
+// numaCPUSets returns the CPUs local to each of the given accelerators, nil
+// meaning all of them, in the order torchrun hands them to the local ranks,
+// and the union of them for the container.
+func numaCPUSets(p acceleratorProvider, root string, selected []int) (perRank []string, all string, err error) {
+	cpus := make(map[int]bool)
+	for _, index := range selectedOrAll(p, root, selected) {
+		list, err := p.LocalCPUs(root, index)
+		if err != nil {
+			return nil, "", errors.WithMessagef(err, "failed to find the cpus local to %s device %d", p.Name(), index)
+		}
+
+		local, err := parseCPUList(list)
+		if err != nil {
+			return nil, "", errors.WithMessagef(err, "bad cpu list for %s device %d", p.Name(), index)
+		}
+		for _, cpu := range local {
+			cpus[cpu] = true
+		}
+		perRank = append(perRank, formatCPUList(local))
+	}
+
+	if len(cpus) == 0 {
+		return nil, "", errors.Errorf("no %s devices to pin cpus to", p.Name())
+	}
+
+	merged := make([]int, 0, len(cpus))
+	for cpu := range cpus {
+		merged = append(merged, cpu)
+	}
+
+	return perRank, formatCPUList(merged), nil
+}
+
+// readCPUList reads a sysfs local_cpulist file.
+func readCPUList(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// parseCPUList parses the kernel cpu list format, e.g. 0-3,8,10-11.
+func parseCPUList(list string) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, errors.Errorf("invalid cpu %q", part)
+		}
+
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, errors.Errorf("invalid cpu range %q", part)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	if len(cpus) == 0 {
+		return nil, errors.Errorf("empty cpu list %q", list)
+	}
+
+	return cpus, nil
+}
+
+func formatCPUList(cpus []int) string {
+	sorted := append([]int{}, cpus...)
+	sort.Ints(sorted)
+
+	parts := make([]string, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, strconv.Itoa(sorted[i])+"-"+strconv.Itoa(sorted[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// resumeCheckpointEnv tells the training code which checkpoint to continue
+// from, as a path inside the container. It is the whole contract with the
+// training code unless a checkpoint argument is given, see ResumeArgs.
+const resumeCheckpointEnv = "INVOKER_RESUME_CHECKPOINT"
+
+// defaultCheckpointPatterns match the top level entries of a run directory
+// that are taken for checkpoints, logs and configs next to them are not.
+var defaultCheckpointPatterns = []string{"checkpoint*", "ckpt*", "step*", "global_step*", "epoch*", "*.ckpt"}
+
+// resumeState is what experiment resume takes over from the previous launch
+// of a run.
+type resumeState struct {
+	previous *RunManifest
+	// checkpoint is the host path of the latest checkpoint, empty if the run
+	// has none.
+	checkpoint string
+	// checkpointArg is the training argument the checkpoint is passed in on
+	// top of the environment, e.g. --resume_from.
+	checkpointArg string
+}
+
+// trainingArgs adds the checkpoint argument to the arguments of the run.
+func (r *resumeState) trainingArgs(layout *Layout, rest []string) []string {
+	if r.checkpointArg == "" || r.checkpoint == "" {
+		return rest
+	}
+
+	return append(append([]string{}, rest...), r.checkpointArg+"="+guestPath(layout, r.checkpoint))
+}
+
+// warnIfCodeChanged points out that the project is mounted from the live
+// tree, so only the image is the one of the previous launch.
+func (r *resumeState) warnIfCodeChanged(current *GitInfo) {
+	previous := r.previous.Git
+	if previous == nil || current == nil {
+		return
+	}
+
+	if previous.Commit != current.Commit {
+		fmt.Printf("warning: the run was launched from commit %s, the project is now at %s\n", previous.Commit, current.Commit)
+	} else if current.Dirty && !previous.Dirty {
+		fmt.Printf("warning: the project has uncommitted changes that the previous launch did not have\n")
+	}
+}
+
+// guestPath maps a path below the cache root to where containers see it.
+func guestPath(layout *Layout, hostPath string) string {
+	rel, err := filepath.Rel(layout.CacheRoot(), hostPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return hostPath
+	}
+
+	return path.Join(guestCachePath, filepath.ToSlash(rel))
+}
+
+type ResumeArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	RunName        string `validate:"required,varname"`
+	// Checkpoint names the checkpoint in the run directory, the latest one
+	// matching CheckpointPatterns if empty.
+	Checkpoint         string
+	CheckpointPatterns []string
+	// CheckpointArg, e.g. --resume_from, is added to the training arguments
+	// with the checkpoint as its value.
+	CheckpointArg string `validate:"omitempty,startswith=-"`
+	CacheDir      string
+}
+
+var checkpointStepPattern = regexp.MustCompile(`[0-9]+`)
+
+// checkpointStep is the last number in the name of a checkpoint, e.g. 1200
+// for checkpoint-1200, -1 if there is none.
+func checkpointStep(name string) int {
+	numbers := checkpointStepPattern.FindAllString(name, -1)
+	if len(numbers) == 0 {
+		return -1
+	}
+
+	step, err := strconv.Atoi(numbers[len(numbers)-1])
+	if err != nil {
+		return -1
+	}
+
+	return step
+}
+
+// latestCheckpoint picks the checkpoint to resume from among the top level
+// entries of the run directory matching patterns: the one with the highest
+// step in its name, the latest modified among equals. It is empty if none
+// match.
+func latestCheckpoint(runDir string, patterns []string) (string, error) {
+	entries, err := runCheckpoints(runDir)
+	if err != nil {
+		return "", err
+	}
+
+	matching := make([]checkpoint, 0, len(entries))
+	for _, entry := range entries {
+		name := filepath.Base(entry.Path)
+		for _, pattern := range patterns {
+			if ok, err := filepath.Match(pattern, name); err != nil {
+				return "", errors.WithMessagef(err, "invalid checkpoint pattern %q", pattern)
+			} else if ok {
+				matching = append(matching, entry)
+				break
+			}
+		}
+	}
+
+	if len(matching) == 0 {
+		return "", nil
+	}
+
+	// runCheckpoints sorts by modification already
+	sort.SliceStable(matching, func(i, j int) bool {
+		return checkpointStep(filepath.Base(matching[i].Path)) < checkpointStep(filepath.Base(matching[j].Path))
+	})
+
+	return matching[len(matching)-1].Path, nil
+}
+
+func loadResumeState(layout *Layout, args ResumeArgs) (*resumeState, error) {
+	manifestPath := layout.RunManifestPath(args.ProjectName, args.ExperimentName, args.RunName)
+	previous, err := loadRunManifest(manifestPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Errorf("run %s of experiment %s has no manifest on this host, use run pull to restore it first", args.RunName, args.ExperimentName)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if previous.Image.ID == "" {
+		return nil, errors.Errorf("%s records no image, the previous launch never started", manifestPath)
+	}
+
+	state := &resumeState{previous: previous, checkpointArg: args.CheckpointArg}
+	runDir := layout.RunDir(args.ProjectName, args.ExperimentName, args.RunName)
+
+	if args.Checkpoint != "" {
+		state.checkpoint = filepath.Join(runDir, filepath.FromSlash(args.Checkpoint))
+		if rel, err := filepath.Rel(runDir, state.checkpoint); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil, errors.Errorf("checkpoint %s is not inside the run directory %s", args.Checkpoint, runDir)
+		}
+		if _, err := os.Stat(state.checkpoint); err != nil {
+			return nil, errors.WithMessagef(err, "checkpoint %s", args.Checkpoint)
+		}
+		return state, nil
+	}
+
+	if state.checkpoint, err = latestCheckpoint(runDir, args.CheckpointPatterns); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Resume launches a run again with the arguments and the image of its last
+// launch and hands the latest checkpoint to the training code.
+func Resume(args ResumeArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(args.CheckpointPatterns) == 0 {
+		args.CheckpointPatterns = defaultCheckpointPatterns
+	}
+
+	state, err := loadResumeState(layout, args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if state.checkpoint != "" {
+		fmt.Printf("resuming %s from %s\n", args.RunName, state.checkpoint)
+	} else {
+		fmt.Printf("resuming %s, it has no checkpoint yet (none matches %s)\n", args.RunName, strings.Join(args.CheckpointPatterns, ", "))
+	}
+
+	runArgs := state.previous.Args
+	runArgs.CacheDir = args.CacheDir
+
+	run(runArgs, state)
+}
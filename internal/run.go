@@ -4,92 +4,422 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
 )
 
+// RunArgs is also recorded in the run manifest, the json names follow the
+// command line flags.
 type RunArgs struct {
-	ProjectName    string   `validate:"required,varname"`
-	Hosts          []string `validate:"required"`
-	NProcPerNode   int      `validate:"required,min=1"`
-	ExperimentName string   `validate:"required,varname"`
-	Port           int      `validate:"required,min=1"`
-	RunName        string   `validate:"required,varname"`
-	MaxRepeats     int      `validate:"required,min=-1"`
-	Rest           []string
-  ContainerName  *string
+	ProjectName      string   `validate:"required,varname" json:"project_name"`
+	Hosts            []string `validate:"required" json:"hosts"`
+	NProcPerNode     int      `validate:"required,min=1" json:"nproc_per_node"`
+	ExperimentName   string   `validate:"required,varname" json:"experiment_name"`
+	Port             int      `validate:"required,min=1" json:"port"`
+	RunName          string   `validate:"required,varname" json:"run_name"`
+	MaxRepeats       int      `validate:"required,min=-1" json:"max_repeats"`
+	Rest             []string `json:"rest"`
+	ContainerName    *string  `json:"container_name,omitempty"`
+	PortRange        string   `json:"port_range,omitempty"`
+	PreflightTimeout int      `validate:"min=0" json:"preflight_timeout"`
+	GPUs             string   `json:"gpus,omitempty"`
+	GPUWait          int      `validate:"min=0" json:"gpu_wait,omitempty"`
+	Accelerator      string   `json:"accelerator,omitempty"`
+	HostProfile      string   `json:"host_profile,omitempty"`
+	Mounts           []string `json:"mount,omitempty"`
+	ShmSize          string   `json:"shm_size,omitempty"`
+	CPUSet           string   `json:"cpuset,omitempty"`
+	CPUPinning       string   `json:"cpu_pinning,omitempty"`
+	Memory           string   `json:"memory,omitempty"`
+	Ulimits          []string `json:"ulimit,omitempty"`
+	IPC              string   `json:"ipc,omitempty"`
+	SecurityMode     string   `json:"security_mode,omitempty"`
+	SeccompProfile   string   `json:"seccomp_profile,omitempty"`
+	AppArmorProfile  string   `json:"apparmor_profile,omitempty"`
+	Privileged       bool     `json:"privileged,omitempty"`
+	CacheDir         string   `json:"cache_dir,omitempty"`
+	RequireClean     bool     `json:"require_clean,omitempty"`
+	IsolateCaches    bool     `json:"isolate_caches,omitempty"`
+	RunNameStyle     string   `json:"run_name_style,omitempty"`
+	RunNonce         string   `json:"run_nonce,omitempty"`
+	Image            string   `json:"image,omitempty"`
+	// Rank is set by the host that launched the run on all hosts, otherwise
+	// every host finds its rank by its addresses.
+	Rank *int `json:"rank,omitempty"`
 }
 
 const runScript = `#!/usr/bin/env python
+import os
+
+# --cpu_pinning=numa, pin this local rank to the cpus local to its gpu
+rank_cpus = os.environ.get("INVOKER_RANK_CPUS")
+if rank_cpus:
+    lists = rank_cpus.split(";")
+    local_rank = int(os.environ.get("LOCAL_RANK", "0"))
+    if local_rank < len(lists):
+        cpus = set()
+        for part in lists[local_rank].split(","):
+            first, _, last = part.partition("-")
+            cpus.update(range(int(first), int(last or first) + 1))
+        os.sched_setaffinity(0, cpus)
+
 from higgsfield.internal.main import cli;
 cli()
 `
+
+// writeRunScript creates the "higgsfield" file torchrun starts in cwd.
+func writeRunScript() error {
+	return os.WriteFile("hf.py", []byte(runScript), 0o644)
+}
+
 func nameFromRunArgs(args RunArgs) string {
-  if args.ContainerName != nil && *args.ContainerName != "" {
+	if args.ContainerName != nil && *args.ContainerName != "" {
 		return *args.ContainerName
-  }
+	}
 
 	return DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
 }
 
 func trimPathForLength(path string, length int) string {
-  // check if path is less than length
-  if len(path) < length {
-    return path
-  }
-
-  // get rid of home directory and replace is with ~
-  // e.g. /home/user/... -> ~/...
-  if path[0] == '/' {
-    path = path[1:]
-  }
-
-  branches := strings.Split(path, "/")
-  slashes := len(branches) - 1
-  if slashes == 0 {
-    return path[:length]
-  }
-
-  if branches[0] == "home" {
-    path = "~/" + strings.Join(branches[2:], "/")
-  }
-
-  if len(path) < length {
-    return path
-  }
-
-  return path[:length] + "..."
+	// check if path is less than length
+	if len(path) < length {
+		return path
+	}
+
+	// get rid of home directory and replace is with ~
+	// e.g. /home/user/... -> ~/...
+	if path[0] == '/' {
+		path = path[1:]
+	}
+
+	branches := strings.Split(path, "/")
+	slashes := len(branches) - 1
+	if slashes == 0 {
+		return path[:length]
+	}
+
+	if branches[0] == "home" {
+		path = "~/" + strings.Join(branches[2:], "/")
+	}
+
+	if len(path) < length {
+		return path
+	}
+
+	return path[:length] + "..."
 }
 
 func Run(args RunArgs) {
+	run(args, nil)
+}
+
+// run launches the experiment, resume is nil for fresh launches.
+func run(args RunArgs, resume *resumeState) {
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	leases := newPortLeases(layout)
+
+	// the port may be derived from the run name, so it has to come first
+	if args.RunName == "" {
+		// recorded in the manifest, which tells the hosts' runs apart from
+		// others on a shared cache
+		if args.RunNonce == "" {
+			args.RunNonce = os.Getenv(runNonceEnv)
+		}
+		if args.RunName, err = generateRunName(args.ExperimentName, args.RunNameStyle, args.RunNonce, len(args.Hosts) > 1, runNameTaken(layout, args.ProjectName, args.ExperimentName)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printGeneratedRunName(args.RunName)
+	}
+
+	if args.Port == 0 {
+		r, err := ParsePortRange(args.PortRange)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// all nodes derive the same port from the run identity, a clash on
+		// the master is reported by its lease and preflight
+		args.Port = hashedPort(r, args.ProjectName, args.ExperimentName, args.RunName)
+		fmt.Printf("derived port %d from the run identity\n", args.Port)
+	}
+
 	if err := Validator().Struct(args); err != nil {
 		panic(err)
 	}
-	
-  master := args.Hosts[0]
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("failed to get current working directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	gitState := projectGitState(cwd, args.RequireClean)
+
+	// the project is mounted from the live tree on resume as well, so its
+	// state is what the launch runs
+	if resume != nil {
+		resume.warnIfCodeChanged(gitState)
+	}
+
+	customProfiles, err := loadCustomHostProfiles(hostProfileDirs())
+	if err != nil {
+		fmt.Printf("failed to load host profiles: %v\n", err)
+		os.Exit(1)
+	}
+
+	root := devRoot()
+	profile, err := selectHostProfile(root, args.HostProfile, customProfiles)
+	if err != nil {
+		fmt.Printf("invalid --host_profile: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("using host profile %s\n", profile.Name)
+
+	accelerator, err := detectAccelerator(root, args.Accelerator)
+	if err != nil {
+		fmt.Printf("invalid --accelerator: %v\n", err)
+		os.Exit(1)
+	}
+
+	gpus, err := parseGPUs(args.GPUs)
+	if err == nil {
+		err = checkAcceleratorsPresent(accelerator, root, gpus.Indices)
+	}
+	if err != nil {
+		fmt.Printf("invalid --gpus: %v\n", err)
+		os.Exit(1)
+	}
+
+	if n := gpus.count(); n != -1 && args.NProcPerNode > n {
+		fmt.Printf("--nproc_per_node=%d but only %d gpus are assigned\n", args.NProcPerNode, n)
+		os.Exit(1)
+	}
+
+	mounts, resources, security := resolveContainerOptions(cwd, args)
+
+	master := args.Hosts[0]
 	rank := 0
 
-	if len(args.Hosts) > 1 {
+	if args.Rank != nil && (*args.Rank < 0 || *args.Rank >= len(args.Hosts)) {
+		fmt.Printf("--rank=%d but there are %d hosts\n", *args.Rank, len(args.Hosts))
+		os.Exit(1)
+	}
+
+	if len(args.Hosts) > 1 && args.Rank != nil {
+		rank = *args.Rank
+	} else if len(args.Hosts) > 1 {
 		master, rank = rankAndMasterElseExit(args.Hosts)
 	} else {
 		master = "localhost"
 	}
 
-	portIsAvailable(args.Port)
 	nodeNum := len(args.Hosts)
+	containerName := nameFromRunArgs(args)
+
+	// keep other invoker runs on this host off the master port from before
+	// preflight until our container is up and holding it
+	if rank == 0 {
+		if err := leases.reservePort(args.Port, containerName, defaultLeaseTTL); err != nil {
+			fmt.Printf("failed to reserve port: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	if !isPortAvailable(args.Port) {
-		fmt.Printf("port %d is not available\n", args.Port)
+	// a launch that fails does not keep the port for the rest of the ttl
+	abort := func() {
+		if rank == 0 {
+			if err := leases.release(containerName); err != nil {
+				fmt.Printf("failed to release port: %v\n", err)
+			}
+		}
 		os.Exit(1)
 	}
 
-	hostCachePath, checkpointDir, err := makeDefaultDirectories(args.ProjectName, args.ExperimentName, args.RunName)
+	preflightTimeout := time.Duration(args.PreflightTimeout) * time.Second
+	if rank == 0 {
+		err = masterPreflight(args.Hosts, args.Port, preflightTimeout)
+	} else {
+		err = workerPreflight(master, args.Port, rank, preflightTimeout)
+	}
 	if err != nil {
+		fmt.Printf("preflight failed: %v\n", err)
+		abort()
+	}
+
+	checkpointDir := layout.RunDir(args.ProjectName, args.ExperimentName, args.RunName)
+	if err := layout.MakeRunDirs(args.ProjectName, args.ExperimentName, args.RunName); err != nil {
 		fmt.Printf("failed to create directories: %v\n", err)
-		os.Exit(1)
+		abort()
+	}
+
+	saveGitPatch(layout, args, cwd, gitState)
+
+	printTrainingInfo(args, containerName, checkpointDir)
+
+	// the manifest keeps the arguments without the checkpoint, for the next
+	// resume to add its own
+	rest := args.Rest
+	if resume != nil {
+		rest = resume.trainingArgs(layout, rest)
+	}
+
+	cmd, cmdArgs := buildArgs(
+		nodeNum,
+		rank,
+		master,
+		args.Port,
+		[]string{"hf.py", "run"},
+		args.NProcPerNode,
+		args.ExperimentName,
+		args.RunName,
+		args.MaxRepeats,
+		rest,
+	)
+
+	if err := writeRunScript(); err != nil {
+		fmt.Printf("failed to create a file: %v\n", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	address := master
+	if len(args.Hosts) > 1 {
+		address = args.Hosts[rank]
+	}
+
+	manifestPath := layout.RunManifestPath(args.ProjectName, args.ExperimentName, args.RunName)
+	manifest := &RunManifest{
+		Project:       args.ProjectName,
+		Experiment:    args.ExperimentName,
+		Run:           args.RunName,
+		Args:          args,
+		Rank:          rank,
+		Master:        master,
+		Port:          args.Port,
+		Command:       append([]string{cmd}, cmdArgs...),
+		Host:          ManifestHost{Hostname: hostname, Address: address},
+		ContainerName: containerName,
+		Image:         ManifestImage{Tag: imageTag},
+		Accelerator:   accelerator.Name(),
+		Git:           gitState,
+		StartedAt:     time.Now(),
+	}
+
+	runOptions := RunOptions{
+		Profile:     profile,
+		Accelerator: accelerator,
+		GPUs:        gpus,
+		GPUWait:     time.Duration(args.GPUWait) * time.Second,
+		Mounts:      mounts,
+		Resources:   resources,
+		Security:    security,
+		Labels: map[string]string{
+			labelProject:    args.ProjectName,
+			labelExperiment: args.ExperimentName,
+			labelRun:        args.RunName,
+		},
+		Git:          gitState,
+		SharedCaches: !args.IsolateCaches,
+		// an already built image, e.g. the one of the sweep this run is a
+		// point of
+		Image: args.Image,
 	}
 
-  containerName := nameFromRunArgs(args)
+	if resume != nil {
+		runOptions.Image = resume.previous.Image.ID
+		manifest.ResumedFrom = &ManifestResume{
+			ContainerID: resume.previous.ContainerID,
+			Checkpoint:  resume.checkpoint,
+		}
+		if resume.checkpoint != "" {
+			runOptions.Env = append(runOptions.Env, resumeCheckpointEnv+"="+guestPath(layout, resume.checkpoint))
+		}
+	}
+
+	dr, err := NewDockerRun(context.Background(), args.ProjectName, cwd, layout, DockerEndpoint{})
+	if err != nil {
+		fmt.Println(err)
+		abort()
+	}
+	info, err := dr.Run(containerName, cmd, cmdArgs, args.Port, runOptions)
+	if err != nil {
+		manifest.Status, manifest.Error = runStatusFailed, err.Error()
+		if err := manifest.save(manifestPath); err != nil {
+			fmt.Printf("failed to write run manifest: %v\n", err)
+		}
 
+		fmt.Printf("error occured while running experiment: %+v\n", err)
+		abort()
+	}
+
+	manifest.started(info, dr.imageDigests(info.Image))
+	if err := manifest.save(manifestPath); err != nil {
+		fmt.Printf("failed to write run manifest: %v\n", err)
+	}
+
+	if rank == 0 {
+		if err := leases.hold(containerName); err != nil {
+			fmt.Printf("failed to update port lease: %v\n", err)
+		}
+	}
+}
+
+// projectGitState reads the git state of the project, exiting if
+// requireClean is set and the tree is not a clean git checkout.
+func projectGitState(cwd string, requireClean bool) *GitInfo {
+	gitState, err := gitInfo(cwd)
+	if err != nil {
+		fmt.Printf("warning: failed to get git state of %s: %v\n", cwd, err)
+	}
+
+	if requireClean {
+		if gitState == nil {
+			fmt.Printf("--require_clean is set but %s is not a git repository\n", cwd)
+			os.Exit(1)
+		}
+		if gitState.Dirty {
+			fmt.Printf("--require_clean is set but %s has uncommitted changes\n", cwd)
+			os.Exit(1)
+		}
+	}
+
+	return gitState
+}
+
+// saveGitPatch keeps what the live tree the image is built from has on top
+// of HEAD next to the run.
+func saveGitPatch(layout *Layout, args RunArgs, cwd string, gitState *GitInfo) {
+	patchPath := filepath.Join(layout.RunMetadataDir(args.ProjectName, args.ExperimentName, args.RunName), "git.patch")
+	if gitState == nil || !gitState.Dirty {
+		// the patch of an earlier launch of the run does not belong to this one
+		_ = os.Remove(patchPath)
+		return
+	}
+
+	patch, err := gitPatch(cwd, gitState)
+	if err == nil {
+		err = writeFileAtomic(patchPath, patch, 0o644, true)
+	}
+	if err != nil {
+		fmt.Printf("warning: failed to save uncommitted changes: %v\n", err)
+	} else {
+		gitState.Patch = patchPath
+	}
+}
+
+func printTrainingInfo(args RunArgs, containerName, checkpointDir string) {
 	fmt.Printf(`
 ╔══════════════════════════════════════════════════════════════════════════════════════════════════════
 ║  
@@ -103,40 +433,48 @@ func Run(args RunArgs) {
 ║
 ╚══════════════════════════════════════════════════════════════════════════════════════════════════════
 `, args.ExperimentName, args.RunName, containerName, trimPathForLength(checkpointDir, 70))
+}
 
-	cmd, cmdArgs := buildArgs(
-		nodeNum,
-		rank,
-		master,
-		args.Port,
-		[]string{"hf.py", "run"},
-		args.NProcPerNode,
-		args.ExperimentName,
-		args.RunName,
-		args.MaxRepeats,
-		args.Rest,
-	)
-
-	cwd, err := os.Getwd()
+// resolveContainerOptions merges the project config with the flags of the
+// run, exiting on invalid values.
+func resolveContainerOptions(cwd string, args RunArgs) ([]mount.Mount, containerResources, containerSecurity) {
+	config, err := loadProjectConfig(cwd)
 	if err != nil {
-		fmt.Printf("failed to get current working directory: %v\n", err)
+		fmt.Printf("failed to load project config: %v\n", err)
 		os.Exit(1)
 	}
 
-	// create a "higgsfield" file in cwd
-	f, err := os.Create("hf.py")
+	mounts, err := resolveMounts(config.Mounts, args.Mounts, !args.IsolateCaches)
 	if err != nil {
-		fmt.Printf("failed to create a file: %v\n", err)
+		fmt.Printf("invalid mounts: %v\n", err)
+		os.Exit(1)
 	}
-	defer f.Close()
 
-	f.Write([]byte(runScript))
+	resources, err := resolveResources(config.Resources, ResourceSpec{
+		ShmSize:    args.ShmSize,
+		CPUSet:     args.CPUSet,
+		CPUPinning: args.CPUPinning,
+		Memory:     args.Memory,
+		Ulimits:    args.Ulimits,
+		IPC:        args.IPC,
+	})
+	if err != nil {
+		fmt.Printf("invalid resources: %v\n", err)
+		os.Exit(1)
+	}
 
-	dr := NewDockerRun(context.Background(), args.ProjectName, cwd, hostCachePath)
-	if err := dr.Run(containerName, cmd, cmdArgs, args.Port); err != nil {
-		fmt.Printf("error occured while running experiment: %+v\n", err)
+	security, err := resolveSecurity(config.Security, SecuritySpec{
+		Mode:     args.SecurityMode,
+		Seccomp:  args.SeccompProfile,
+		AppArmor: args.AppArmorProfile,
+	}, args.Privileged)
+	if err != nil {
+		fmt.Printf("invalid security options: %v\n", err)
 		os.Exit(1)
 	}
+	fmt.Printf("running in %s mode\n", security.Mode)
+
+	return mounts, resources, security
 }
 
 func buildArgs(
@@ -0,0 +1,578 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// objects above s3MultipartThreshold are uploaded in parts of s3PartSize,
+	// single uploads are limited to 5GiB
+	s3MultipartThreshold = 256 << 20
+	s3PartSize           = 64 << 20
+
+	// multipart uploads started longer than s3MultipartRetention ago are
+	// aborted by the next push, whoever started them
+	s3MultipartRetention = 7 * 24 * time.Hour
+
+	s3DefaultRegion = "us-east-1"
+	s3EmptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Store talks to S3 or anything speaking its API, e.g. MinIO. Requests are
+// signed with AWS signature version 4, credentials come from the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+type s3Store struct {
+	client       *http.Client
+	endpoint     *neturl.URL
+	pathStyle    bool
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// multipartThreshold and partSize are s3MultipartThreshold and
+	// s3PartSize, smaller in tests.
+	multipartThreshold int64
+	partSize           int
+	uploads            *multipartUploads
+}
+
+// newS3Store creates a store for bucket/prefix. Without an endpoint AWS is
+// used with virtual hosted buckets, custom endpoints get path style ones.
+// Unfinished multipart uploads are remembered in uploadsPath.
+func newS3Store(bucket, prefix, endpoint, uploadsPath string) (*s3Store, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	s := &s3Store{
+		client:       &http.Client{},
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+
+		multipartThreshold: s3MultipartThreshold,
+		partSize:           s3PartSize,
+		uploads:            loadMultipartUploads(uploadsPath),
+	}
+
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY have to be set for s3 targets")
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	} else {
+		s.pathStyle = true
+	}
+
+	u, err := neturl.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+	s.endpoint = u
+
+	return s, nil
+}
+
+func (s *s3Store) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+func (s *s3Store) objectURL(key string, query neturl.Values) *neturl.URL {
+	return s.bucketURL(strings.TrimPrefix(s.prefix+"/"+key, "/"), query)
+}
+
+// bucketURL is the url of key in the bucket, ignoring the prefix. An empty
+// key is the bucket itself.
+func (s *s3Store) bucketURL(key string, query neturl.Values) *neturl.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Path = "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = canonicalQuery(query)
+
+	return &u
+}
+
+// uriEncode escapes everything but the unreserved characters, as signature
+// version 4 wants it.
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func canonicalQuery(query neturl.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the signature version 4 headers to req, payloadHash is the hex
+// sha256 of the body.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "host" || name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request, anything but a 2xx response is an error.
+func (s *s3Store) do(method, key string, query neturl.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	return s.doURL(method, key, s.objectURL(key, query), body, size, payloadHash)
+}
+
+// doURL sends a signed request to u, name stands for it in errors.
+func (s *s3Store) doURL(method, name string, u *neturl.URL, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create request")
+	}
+	// keep the escaping we signed
+	req.URL.RawPath = uriEncode(u.Path, true)
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "%s %s failed", method, name)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+		var s3Err s3Error
+		if xml.Unmarshal(content, &s3Err) == nil && s3Err.Code != "" {
+			return resp, errors.Errorf("%s %s failed: %s: %s", method, name, s3Err.Code, s3Err.Message)
+		}
+		return resp, errors.Errorf("%s %s failed: %s", method, name, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (s *s3Store) exists(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0, s3EmptySHA256)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+func (s *s3Store) get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0, s3EmptySHA256)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, errArtifactNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *s3Store) put(key string, r io.ReadSeeker, size int64, sum string) error {
+	if size > s.multipartThreshold {
+		return s.putMultipart(key, r)
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, r, size, sum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber" json:"part_number"`
+	ETag       string `xml:"ETag" json:"etag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// multipartUpload is an upload that did not complete. It is kept, not
+// aborted, so that the next push continues it: objects are stored by their
+// content, the parts uploaded for a key stay valid. After
+// s3MultipartRetention it is aborted, see abortStaleUploads.
+type multipartUpload struct {
+	UploadID string            `json:"upload_id"`
+	Parts    []s3CompletedPart `json:"parts"`
+}
+
+// multipartUploads remembers the unfinished uploads by store and key. Pushes
+// running at the same time may lose each other's entries, which only costs
+// uploading those parts again.
+type multipartUploads struct {
+	path    string
+	entries map[string]*multipartUpload
+}
+
+func loadMultipartUploads(path string) *multipartUploads {
+	u := &multipartUploads{path: path, entries: map[string]*multipartUpload{}}
+
+	// a broken file only costs uploading again
+	if content, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(content, &u.entries)
+	}
+
+	return u
+}
+
+func (u *multipartUploads) save() error {
+	if u.path == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(u.entries, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode multipart uploads")
+	}
+
+	return writeFileAtomic(u.path, content, 0o644, true)
+}
+
+func (s *s3Store) saveUploads() {
+	if err := s.uploads.save(); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+}
+
+type s3ListPartsResult struct {
+	IsTruncated          bool `xml:"IsTruncated"`
+	NextPartNumberMarker int  `xml:"NextPartNumberMarker"`
+	Parts                []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// listParts returns the ETags of the parts S3 has of an upload, by number.
+func (s *s3Store) listParts(key, uploadID string) (map[int]string, error) {
+	etags := make(map[int]string)
+	marker := 0
+	for {
+		query := neturl.Values{"uploadId": {uploadID}}
+		if marker > 0 {
+			query.Set("part-number-marker", fmt.Sprint(marker))
+		}
+
+		resp, err := s.do(http.MethodGet, key, query, nil, 0, s3EmptySHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListPartsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse the parts of %s", key)
+		}
+
+		for _, part := range result.Parts {
+			etags[part.PartNumber] = part.ETag
+		}
+
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			return etags, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// resumeMultipart returns the parts of an earlier upload of key that S3
+// still has, or nil if there is no such upload.
+func (s *s3Store) resumeMultipart(key string) (*multipartUpload, map[int]s3CompletedPart) {
+	id := s.String() + "/" + key
+	upload := s.uploads.entries[id]
+	if upload == nil {
+		return nil, nil
+	}
+
+	listed, err := s.listParts(key, upload.UploadID)
+	if err != nil {
+		// aborted, completed or expired by a lifecycle rule
+		fmt.Printf("starting the upload of %s over: %v\n", key, err)
+		delete(s.uploads.entries, id)
+		return nil, nil
+	}
+
+	done := make(map[int]s3CompletedPart, len(upload.Parts))
+	parts := make([]s3CompletedPart, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		if listed[part.PartNumber] == part.ETag {
+			done[part.PartNumber] = part
+			parts = append(parts, part)
+		}
+	}
+	upload.Parts = parts
+	fmt.Printf("resuming the upload of %s, %d parts are there already\n", key, len(done))
+
+	return upload, done
+}
+
+func (s *s3Store) startMultipart(key string) (*multipartUpload, error) {
+	resp, err := s.do(http.MethodPost, key, neturl.Values{"uploads": {""}}, nil, 0, s3EmptySHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to start multipart upload of %s", key)
+	}
+
+	upload := &multipartUpload{UploadID: initiated.UploadID}
+	s.uploads.entries[s.String()+"/"+key] = upload
+	s.saveUploads()
+
+	return upload, nil
+}
+
+type s3ListMultipartUploadsResult struct {
+	IsTruncated        bool   `xml:"IsTruncated"`
+	NextKeyMarker      string `xml:"NextKeyMarker"`
+	NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+	Uploads            []struct {
+		Key       string    `xml:"Key"`
+		UploadID  string    `xml:"UploadId"`
+		Initiated time.Time `xml:"Initiated"`
+	} `xml:"Upload"`
+}
+
+// abortStaleUploads aborts the multipart uploads under the objects of the
+// store that were started before now minus s3MultipartRetention, so that
+// pushes that are never resumed, here or on other hosts, do not keep their
+// parts forever. It is no replacement for a lifecycle rule: stores that are
+// not pushed to any more are not cleaned up.
+func (s *s3Store) abortStaleUploads(now time.Time) error {
+	prefix := strings.TrimPrefix(s.prefix+"/objects/", "/")
+	query := neturl.Values{"uploads": {""}, "prefix": {prefix}}
+	for {
+		resp, err := s.doURL(http.MethodGet, "multipart uploads", s.bucketURL("", query), nil, 0, s3EmptySHA256)
+		if err != nil {
+			return err
+		}
+
+		var result s3ListMultipartUploadsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return errors.WithMessage(err, "failed to parse the multipart uploads")
+		}
+
+		for _, upload := range result.Uploads {
+			if now.Sub(upload.Initiated) < s3MultipartRetention || !strings.HasPrefix(upload.Key, prefix) {
+				continue
+			}
+
+			key := strings.TrimPrefix(strings.TrimPrefix(upload.Key, s.prefix), "/")
+			resp, err := s.do(http.MethodDelete, key, neturl.Values{"uploadId": {upload.UploadID}}, nil, 0, s3EmptySHA256)
+			if err != nil {
+				return errors.WithMessagef(err, "failed to abort the upload of %s", key)
+			}
+			resp.Body.Close()
+			fmt.Printf("aborted the upload of %s started %s\n", key, upload.Initiated.Format(time.RFC3339))
+
+			id := s.String() + "/" + key
+			if remembered := s.uploads.entries[id]; remembered != nil && remembered.UploadID == upload.UploadID {
+				delete(s.uploads.entries, id)
+				s.saveUploads()
+			}
+		}
+
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			return nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("upload-id-marker", result.NextUploadIDMarker)
+	}
+}
+
+// putMultipart uploads r in parts. An upload that fails is left for the next
+// push to continue, parts S3 already has are not sent again.
+func (s *s3Store) putMultipart(key string, r io.Reader) error {
+	upload, done := s.resumeMultipart(key)
+	if upload == nil {
+		var err error
+		if upload, err = s.startMultipart(key); err != nil {
+			return err
+		}
+	}
+
+	var complete s3CompleteMultipartUpload
+	buf := make([]byte, s.partSize)
+	for number := 1; ; number++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return errors.WithMessagef(readErr, "failed to read part %d of %s", number, key)
+		}
+
+		completed, ok := done[number]
+		if !ok {
+			part := buf[:n]
+			sum := sha256.Sum256(part)
+			query := neturl.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {upload.UploadID}}
+			resp, err := s.do(http.MethodPut, key, query, bytes.NewReader(part), int64(n), hex.EncodeToString(sum[:]))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			completed = s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")}
+			upload.Parts = append(upload.Parts, completed)
+			s.saveUploads()
+		}
+		complete.Parts = append(complete.Parts, completed)
+
+		if readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode multipart upload")
+	}
+
+	sum := sha256.Sum256(body)
+	resp, err := s.do(http.MethodPost, key, neturl.Values{"uploadId": {upload.UploadID}}, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the upload can still fail after a 200, reported in the body
+	content, _ := io.ReadAll(resp.Body)
+	var s3Err s3Error
+	if xml.Unmarshal(content, &s3Err) == nil && s3Err.Code != "" {
+		return errors.Errorf("failed to complete multipart upload of %s: %s: %s", key, s3Err.Code, s3Err.Message)
+	}
+
+	delete(s.uploads.entries, s.String()+"/"+key)
+	s.saveUploads()
+
+	return nil
+}
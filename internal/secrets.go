@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// secretsKeyEnv holds a base64 encoded 32 byte key when --key_file is not given.
+	secretsKeyEnv = "INVOKER_SECRETS_KEY"
+
+	// encrypted payloads are prefixed so that decode-secrets can tell them
+	// apart from the legacy plain base64 ones.
+	encryptedSecretsPrefix = "hfenc:v1:"
+
+	secretsKeySize   = 32
+	secretsNonceSize = 24
+)
+
+func GenerateSecretsKey() string {
+	var key [secretsKeySize]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		fmt.Printf("failed to generate key: %v\n", err)
+		os.Exit(1)
+	}
+
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// loadSecretsKey reads the key from keyFile, falling back to the
+// INVOKER_SECRETS_KEY environment variable. It returns nil if neither is set.
+func loadSecretsKey(keyFile string) (*[secretsKeySize]byte, error) {
+	var encoded string
+	switch {
+	case keyFile != "":
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read key file %s", keyFile)
+		}
+		encoded = string(content)
+	case os.Getenv(secretsKeyEnv) != "":
+		encoded = os.Getenv(secretsKeyEnv)
+	default:
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.WithMessage(err, "key is not valid base64")
+	}
+
+	if len(raw) != secretsKeySize {
+		return nil, errors.Errorf("key must be %d bytes, got %d", secretsKeySize, len(raw))
+	}
+
+	var key [secretsKeySize]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// readSecretsPayload returns the payload from input ("-" is stdin), or from
+// arg if no input is given, or from stdin if neither is set.
+func readSecretsPayload(arg, input string) ([]byte, error) {
+	switch {
+	case input == "-" || (input == "" && arg == ""):
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to read stdin")
+		}
+		return content, nil
+	case input != "":
+		content, err := os.ReadFile(input)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read %s", input)
+		}
+		return content, nil
+	default:
+		return []byte(arg), nil
+	}
+}
+
+func isEncryptedSecrets(payload string) bool {
+	return strings.HasPrefix(payload, encryptedSecretsPrefix)
+}
+
+func encryptSecrets(plaintext []byte, key *[secretsKeySize]byte) (string, error) {
+	var nonce [secretsNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", errors.WithMessage(err, "failed to generate nonce")
+	}
+
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+	return encryptedSecretsPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecrets opens the payload and fails if it was not produced with the
+// same key or was modified in transit.
+func decryptSecrets(payload string, key *[secretsKeySize]byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(payload, encryptedSecretsPrefix))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to decode base64 string")
+	}
+
+	if len(raw) < secretsNonceSize+secretbox.Overhead {
+		return nil, errors.New("encrypted payload is too short")
+	}
+
+	var nonce [secretsNonceSize]byte
+	copy(nonce[:], raw[:secretsNonceSize])
+
+	plaintext, ok := secretbox.Open(nil, raw[secretsNonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("integrity check failed: wrong key or corrupted payload")
+	}
+
+	return plaintext, nil
+}
+
+type EncodeSecretsArgs struct {
+	Input   string
+	KeyFile string
+}
+
+func EncodeSecrets(args EncodeSecretsArgs) {
+	key, err := loadSecretsKey(args.KeyFile)
+	if err != nil {
+		fmt.Printf("failed to load key: %v\n", err)
+		os.Exit(1)
+	}
+
+	if key == nil {
+		fmt.Printf("no key given, use --key_file or set %s\n", secretsKeyEnv)
+		os.Exit(1)
+	}
+
+	plaintext, err := readSecretsPayload("", args.Input)
+	if err != nil {
+		fmt.Printf("failed to read secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	encrypted, err := encryptSecrets(plaintext, key)
+	if err != nil {
+		fmt.Printf("failed to encrypt secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Print(encrypted)
+}
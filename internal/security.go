@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+const (
+	securityModePrivileged = "privileged"
+	securityModeHardened   = "hardened"
+)
+
+// SecuritySpec picks how much of the host the container gets. Privileged is
+// the historical behaviour: a privileged container in the host pid
+// namespace. Hardened drops both and only grants the device mappings and
+// capabilities the host profile asks for.
+type SecuritySpec struct {
+	Mode string `json:"mode,omitempty"`
+	// Seccomp is a path to a seccomp profile, hardened mode only.
+	Seccomp string `json:"seccomp,omitempty"`
+	// AppArmor is the name of a loaded AppArmor profile, hardened mode only.
+	AppArmor string `json:"apparmor,omitempty"`
+}
+
+type containerSecurity struct {
+	Mode        string
+	SecurityOpt []string
+}
+
+// resolveSecurity merges the project config with the command line. The
+// privileged flag is an escape hatch that wins over everything else.
+func resolveSecurity(config, flags SecuritySpec, privileged bool) (containerSecurity, error) {
+	spec := config
+	if flags.Mode != "" {
+		spec.Mode = flags.Mode
+	}
+	if flags.Seccomp != "" {
+		spec.Seccomp = flags.Seccomp
+	}
+	if flags.AppArmor != "" {
+		spec.AppArmor = flags.AppArmor
+	}
+
+	if privileged {
+		spec.Mode = securityModePrivileged
+	}
+
+	switch spec.Mode {
+	case "", securityModePrivileged:
+		if spec.Seccomp != "" || spec.AppArmor != "" {
+			fmt.Printf("warning: seccomp and apparmor profiles are ignored for privileged containers\n")
+		}
+		return containerSecurity{Mode: securityModePrivileged}, nil
+	case securityModeHardened:
+	default:
+		return containerSecurity{}, errors.Errorf("invalid security mode %q, expected privileged or hardened", spec.Mode)
+	}
+
+	security := containerSecurity{
+		Mode:        securityModeHardened,
+		SecurityOpt: []string{"no-new-privileges:true"},
+	}
+
+	if spec.Seccomp != "" {
+		content, err := os.ReadFile(spec.Seccomp)
+		if err != nil {
+			return security, errors.WithMessage(err, "failed to read seccomp profile")
+		}
+
+		// the daemon wants the profile itself, compacted onto one line
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, content); err != nil {
+			return security, errors.WithMessagef(err, "seccomp profile %s is not valid json", spec.Seccomp)
+		}
+		security.SecurityOpt = append(security.SecurityOpt, "seccomp="+compact.String())
+	}
+
+	if spec.AppArmor != "" {
+		security.SecurityOpt = append(security.SecurityOpt, "apparmor="+spec.AppArmor)
+	}
+
+	return security, nil
+}
+
+// privileged tells whether the container gets all of the host, which is
+// anything but hardened mode.
+func (s containerSecurity) privileged() bool {
+	return s.Mode != securityModeHardened
+}
+
+// apply sets the security related fields of the host config.
+func (s containerSecurity) apply(hostConfig *container.HostConfig, profile HostProfile) {
+	hostConfig.CapAdd = profile.CapAdd
+
+	if s.privileged() {
+		hostConfig.Privileged = true
+		hostConfig.PidMode = container.PidMode("host")
+		return
+	}
+
+	hostConfig.SecurityOpt = s.SecurityOpt
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHSpec is how invoker reaches the other hosts.
+type SSHSpec struct {
+	// User defaults to the local user.
+	User string
+	Port int `validate:"min=1,max=65535"`
+	// Key is a private key file used next to the keys of ssh-agent.
+	Key string
+	// KnownHosts defaults to ~/.ssh/known_hosts, unknown hosts are refused.
+	KnownHosts string
+	// Timeout is the number of seconds to wait for a connection.
+	Timeout int `validate:"min=0"`
+}
+
+type sshTransport struct {
+	config *ssh.ClientConfig
+	port   int
+}
+
+func newSSHTransport(spec SSHSpec) (*sshTransport, error) {
+	username := spec.User
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to get the current user, pass --ssh_user")
+		}
+		username = current.Username
+	}
+
+	knownHostsPath := spec.KnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to get home directory, pass --ssh_known_hosts")
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to load %s", knownHostsPath)
+	}
+
+	var auth []ssh.AuthMethod
+	if spec.Key != "" {
+		content, err := os.ReadFile(spec.Key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read %s", spec.Key)
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse %s, keys with a passphrase have to be added to ssh-agent", spec.Key)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to connect to ssh-agent at %s", socket)
+		}
+		// the connection is used for the lifetime of the process
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(auth) == 0 {
+		return nil, errors.New("no ssh credentials, start ssh-agent or pass --ssh_key")
+	}
+
+	return &sshTransport{
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         time.Duration(spec.Timeout) * time.Second,
+		},
+		port: spec.Port,
+	}, nil
+}
+
+func (t *sshTransport) dial(host string) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(t.port))
+	client, err := ssh.Dial("tcp", addr, t.config)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to connect to %s", addr)
+	}
+
+	return client, nil
+}
+
+// run executes command on host through the shell of the remote user. When
+// ctx is done the command is sent SIGTERM and the connection closed.
+func (t *sshTransport) run(ctx context.Context, host, command string, stdout, stderr io.Writer) error {
+	client, err := t.dial(host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.WithMessagef(err, "failed to open a session on %s", host)
+	}
+	defer session.Close()
+
+	session.Stdout, session.Stderr = stdout, stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGTERM)
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	err = session.Run(command)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+type hostResult struct {
+	Host    string
+	Rank    int
+	Err     error
+	Elapsed time.Duration
+}
+
+// fanOut runs a command on every host at once, command gets the rank of the
+// host, its position in hosts. Output lines are prefixed with the host. A
+// timeout of 0 waits as long as it takes.
+func (t *sshTransport) fanOut(ctx context.Context, hosts []string, timeout time.Duration, command func(rank int, host string) string) []hostResult {
+	results := make([]hostResult, len(hosts))
+	var output sync.Mutex
+	var wg sync.WaitGroup
+
+	for rank, host := range hosts {
+		wg.Add(1)
+		go func(rank int, host string) {
+			defer wg.Done()
+
+			hostCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				hostCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			out := newPrefixWriter(&output, os.Stdout, "["+host+"] ")
+			start := time.Now()
+			err := t.run(hostCtx, host, command(rank, host), out, out)
+			out.Flush()
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = errors.Errorf("timed out after %s", timeout)
+			}
+			results[rank] = hostResult{Host: host, Rank: rank, Err: err, Elapsed: time.Since(start)}
+		}(rank, host)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// printHostResults prints a line per host and tells whether all succeeded.
+func printHostResults(results []hostResult) bool {
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "HOST\tRANK\tTIME\tRESULT\n")
+	for _, r := range results {
+		result := "ok"
+		if r.Err != nil {
+			result = "failed: " + r.Err.Error()
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.Host, r.Rank, r.Elapsed.Round(time.Second), result)
+	}
+	w.Flush()
+
+	return ok
+}
+
+// shellQuote quotes s for a posix shell.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@%+", r))
+	}) == -1 {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellCommand runs argv in dir on the remote host, in the home directory if
+// dir is empty.
+func shellCommand(dir string, argv []string) string {
+	quoted := make([]string, 0, len(argv))
+	for _, arg := range argv {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	if dir == "" {
+		return strings.Join(quoted, " ")
+	}
+
+	return "cd " + shellQuote(dir) + " && " + strings.Join(quoted, " ")
+}
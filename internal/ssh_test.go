@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"invoker", "invoker"},
+		{"--hosts=a,b", "--hosts=a,b"},
+		{"/srv/my-project_1", "/srv/my-project_1"},
+		{"", "''"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"a;rm -rf /", "'a;rm -rf /'"},
+		{"`id`", "'`id`'"},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	argv := []string{"invoker", "experiment", "run", "--", "--note", "it's $HOME"}
+
+	if got, want := shellCommand("", argv), `invoker experiment run -- --note 'it'\''s $HOME'`; got != want {
+		t.Errorf("shellCommand = %s, want %s", got, want)
+	}
+	if got, want := shellCommand("/home/me/my project", argv[:1]), "cd '/home/me/my project' && invoker"; got != want {
+		t.Errorf("shellCommand in dir = %s, want %s", got, want)
+	}
+
+	// what a shell makes of it is the argv again
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	args := []string{"", "two words", "it's", "$HOME", "`id`", "a\nb", `back\slash`}
+	out, err := exec.Command("sh", "-c", shellCommand("", append([]string{"printf", `%s\0`}, args...))).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	for _, arg := range args {
+		want += arg + "\x00"
+	}
+	if string(out) != want {
+		t.Errorf("sh got %q, want %q", out, want)
+	}
+}
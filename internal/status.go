@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+type StatusArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	CacheDir       string
+}
+
+func nameFromStatusArgs(args StatusArgs) string {
+	if args.ContainerName != nil && *args.ContainerName != "" {
+		return *args.ContainerName
+	}
+
+	return DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
+}
+
+func (d *DockerRun) Inspect(containerName string) (types.ContainerJSON, error) {
+	info, err := d.client.ContainerInspect(d.ctx, containerName)
+	if client.IsErrNotFound(err) {
+		return info, errors.Errorf("container %s not found", containerName)
+	} else if err != nil {
+		return info, errors.WithMessagef(err, "failed to inspect container %s", containerName)
+	}
+
+	return info, nil
+}
+
+func Status(args StatusArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		panic(err)
+	}
+
+	dr, err := NewDockerRun(context.Background(), args.ProjectName, cwd, layout, DockerEndpoint{})
+	if err != nil {
+		panic(err)
+	}
+	info, err := dr.Inspect(nameFromStatusArgs(args))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dr.recordExit(info)
+	printContainerStatus(info)
+}
+
+// recordExit finishes the run manifest if the container has exited. Nothing
+// waits for containers, so their end is recorded by whoever sees it first.
+func (d *DockerRun) recordExit(info types.ContainerJSON) {
+	if info.State == nil || (info.State.Status != "exited" && info.State.Status != "dead") {
+		return
+	}
+
+	if err := d.finalizeRunManifest(info, false); err != nil {
+		fmt.Printf("failed to update run manifest: %v\n", err)
+	}
+}
+
+func printContainerStatus(info types.ContainerJSON) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	labels := info.Config.Labels
+	state := info.State.Status
+	if !info.State.Running && info.State.FinishedAt != "" {
+		state = fmt.Sprintf("%s (exit code %d, finished %s)", state, info.State.ExitCode, info.State.FinishedAt)
+	}
+
+	fmt.Fprintf(w, "container\t%s (%s)\n", strings.TrimPrefix(info.Name, "/"), info.ID[:12])
+	fmt.Fprintf(w, "state\t%s\n", state)
+	fmt.Fprintf(w, "started\t%s\n", info.State.StartedAt)
+	fmt.Fprintf(w, "image\t%s (%s)\n", info.Config.Image, info.Image)
+	fmt.Fprintf(w, "experiment\t%s\n", labels[labelExperiment])
+	fmt.Fprintf(w, "run\t%s\n", labels[labelRun])
+	fmt.Fprintf(w, "gpus\t%s\n", valueOr(labels[labelGPUs], "-"))
+
+	commit := valueOr(labels[labelGitCommit], "-")
+	if labels[labelGitDirty] == "true" {
+		commit += " (dirty)"
+	}
+	fmt.Fprintf(w, "commit\t%s\n", commit)
+
+	hostConfig := info.HostConfig
+	mode := valueOr(labels[labelSecurity], securityModePrivileged)
+	fmt.Fprintf(w, "security\t%s\n", mode)
+	fmt.Fprintf(w, "  privileged\t%t\n", hostConfig.Privileged)
+	fmt.Fprintf(w, "  pid namespace\t%s\n", valueOr(string(hostConfig.PidMode), "private"))
+	fmt.Fprintf(w, "  ipc namespace\t%s\n", valueOr(string(hostConfig.IpcMode), "private"))
+	fmt.Fprintf(w, "  capabilities\t%s\n", valueOr(strings.Join(hostConfig.CapAdd, ", "), "docker defaults"))
+
+	opts := make([]string, 0, len(hostConfig.SecurityOpt))
+	for _, opt := range hostConfig.SecurityOpt {
+		// seccomp profiles are passed inline and would flood the output
+		if strings.HasPrefix(opt, "seccomp=") && opt != "seccomp=unconfined" {
+			opt = "seccomp=<custom profile>"
+		}
+		opts = append(opts, opt)
+	}
+	fmt.Fprintf(w, "  security options\t%s\n", valueOr(strings.Join(opts, ", "), "-"))
+
+	devices := make([]string, 0, len(hostConfig.Devices))
+	for _, device := range hostConfig.Devices {
+		devices = append(devices, device.PathOnHost)
+	}
+	if hostConfig.Privileged {
+		devices = append(devices, "all host devices")
+	}
+	fmt.Fprintf(w, "  devices\t%s\n", valueOr(strings.Join(devices, ", "), "-"))
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+type EndpointStatusArgs struct {
+	Status    StatusArgs
+	Hosts     []string `validate:"required,min=1"`
+	Endpoints DockerEndpoints
+}
+
+// StatusOnEndpoints prints the status of the experiment container on every
+// host through its docker daemon.
+func StatusOnEndpoints(args EndpointStatusArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+	if err := args.Endpoints.check(args.Hosts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.Status.CacheDir)
+	if err != nil {
+		panic(err)
+	}
+
+	containerName := nameFromStatusArgs(args.Status)
+	ok := true
+	for rank, host := range args.Hosts {
+		if rank > 0 {
+			fmt.Println()
+		}
+
+		endpoint := args.Endpoints.forHost(host)
+		fmt.Printf("rank %d on %s through %s\n", rank, host, endpoint)
+
+		dr, err := NewDockerRun(context.Background(), args.Status.ProjectName, cwd, layout, endpoint)
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+
+		info, err := dr.Inspect(containerName)
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+
+		// the manifest of rank 0 is local, the container IDs tell them apart
+		dr.recordExit(info)
+		printContainerStatus(info)
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,877 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+const (
+	sweepMethodGrid   = "grid"
+	sweepMethodRandom = "random"
+	sweepMethodList   = "list"
+
+	sweepPointPending   = "pending"
+	sweepPointRunning   = "running"
+	sweepPointCompleted = "completed"
+	sweepPointFailed    = "failed"
+)
+
+// parameters become flags of the training code
+var sweepParameterRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// SweepSpec is read from the --spec file. Parameters map a flag of the
+// training code to its values, random sweeps also take ranges:
+//
+//	{"method": "random", "samples": 16, "parameters": {
+//	    "lr": {"min": 1e-5, "max": 1e-2, "log": true},
+//	    "batch_size": [32, 64, 128]}}
+//
+// List sweeps name their points instead:
+//
+//	{"method": "list", "points": [{"lr": 0.1}, {"lr": 0.01, "warmup": 500}]}
+type SweepSpec struct {
+	// Method is grid, random or list, grid if not given.
+	Method     string                       `json:"method,omitempty"`
+	Parameters map[string]json.RawMessage   `json:"parameters,omitempty"`
+	Points     []map[string]json.RawMessage `json:"points,omitempty"`
+	// Samples is the number of points of a random sweep.
+	Samples int `json:"samples,omitempty"`
+	// Seed of a random sweep, derived from the sweep name if not given so
+	// the points stay the same when the sweep is started again.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+type sweepRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Log bool    `json:"log,omitempty"`
+	Int bool    `json:"int,omitempty"`
+}
+
+func (r sweepRange) sample(rnd *rand.Rand) string {
+	var v float64
+	if r.Log {
+		v = math.Exp(math.Log(r.Min) + rnd.Float64()*(math.Log(r.Max)-math.Log(r.Min)))
+	} else {
+		v = r.Min + rnd.Float64()*(r.Max-r.Min)
+	}
+
+	if r.Int {
+		return strconv.FormatInt(int64(math.Round(v)), 10)
+	}
+
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// sweepParameter holds either the values or the range of a parameter.
+type sweepParameter struct {
+	name   string
+	values []string
+	rng    *sweepRange
+}
+
+func loadSweepSpec(path string) (*SweepSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	var spec SweepSpec
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return &spec, nil
+}
+
+// formatSweepValue keeps numbers as written in the spec.
+func formatSweepValue(raw json.RawMessage) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", errors.Errorf("expected a string, number or boolean, got %s", raw)
+	}
+}
+
+func parseSweepParameter(name string, raw json.RawMessage, method string) (sweepParameter, error) {
+	p := sweepParameter{name: name}
+	if !sweepParameterRegex.MatchString(name) {
+		return p, errors.Errorf("invalid parameter name %q", name)
+	}
+
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		if method != sweepMethodRandom {
+			return p, errors.Errorf("parameter %s: ranges are only supported by random sweeps", name)
+		}
+
+		var r sweepRange
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&r); err != nil {
+			return p, errors.WithMessagef(err, "parameter %s: invalid range", name)
+		}
+		if r.Min >= r.Max {
+			return p, errors.Errorf("parameter %s: min has to be below max", name)
+		}
+		if r.Log && r.Min <= 0 {
+			return p, errors.Errorf("parameter %s: log ranges have to be positive", name)
+		}
+
+		p.rng = &r
+		return p, nil
+	}
+
+	var values []json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return p, errors.Errorf("parameter %s: expected a list of values", name)
+	}
+	if len(values) == 0 {
+		return p, errors.Errorf("parameter %s has no values", name)
+	}
+
+	for _, value := range values {
+		v, err := formatSweepValue(value)
+		if err != nil {
+			return p, errors.WithMessagef(err, "parameter %s", name)
+		}
+		p.values = append(p.values, v)
+	}
+
+	return p, nil
+}
+
+// points expands the spec into the parameter values of every point. Grid
+// points vary the last parameter, by name, fastest.
+func (s *SweepSpec) points(sweepName string) ([]map[string]string, error) {
+	method := s.Method
+	if method == "" {
+		method = sweepMethodGrid
+	}
+
+	switch method {
+	case sweepMethodList:
+		if len(s.Parameters) > 0 {
+			return nil, errors.New("list sweeps take points, not parameters")
+		}
+		if len(s.Points) == 0 {
+			return nil, errors.New("the sweep has no points")
+		}
+
+		points := make([]map[string]string, 0, len(s.Points))
+		for i, raw := range s.Points {
+			point := make(map[string]string, len(raw))
+			for name, value := range raw {
+				if !sweepParameterRegex.MatchString(name) {
+					return nil, errors.Errorf("point %d: invalid parameter name %q", i, name)
+				}
+				v, err := formatSweepValue(value)
+				if err != nil {
+					return nil, errors.WithMessagef(err, "point %d, parameter %s", i, name)
+				}
+				point[name] = v
+			}
+			points = append(points, point)
+		}
+
+		return points, nil
+	case sweepMethodGrid, sweepMethodRandom:
+	default:
+		return nil, errors.Errorf("invalid sweep method %q, expected %s, %s or %s", method, sweepMethodGrid, sweepMethodRandom, sweepMethodList)
+	}
+
+	if len(s.Points) > 0 {
+		return nil, errors.Errorf("%s sweeps take parameters, not points", method)
+	}
+	if len(s.Parameters) == 0 {
+		return nil, errors.New("the sweep has no parameters")
+	}
+
+	names := make([]string, 0, len(s.Parameters))
+	for name := range s.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]sweepParameter, 0, len(names))
+	for _, name := range names {
+		p, err := parseSweepParameter(name, s.Parameters[name], method)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+
+	if method == sweepMethodGrid {
+		points := []map[string]string{{}}
+		for _, p := range params {
+			next := make([]map[string]string, 0, len(points)*len(p.values))
+			for _, point := range points {
+				for _, v := range p.values {
+					extended := make(map[string]string, len(point)+1)
+					for name, value := range point {
+						extended[name] = value
+					}
+					extended[p.name] = v
+					next = append(next, extended)
+				}
+			}
+			points = next
+		}
+
+		return points, nil
+	}
+
+	if s.Samples < 1 {
+		return nil, errors.New("random sweeps need samples")
+	}
+
+	seed := s.Seed
+	if seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(sweepName))
+		seed = int64(h.Sum64())
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	points := make([]map[string]string, 0, s.Samples)
+	for i := 0; i < s.Samples; i++ {
+		point := make(map[string]string, len(params))
+		for _, p := range params {
+			if p.rng != nil {
+				point[p.name] = p.rng.sample(rnd)
+			} else {
+				point[p.name] = p.values[rnd.Intn(len(p.values))]
+			}
+		}
+		points = append(points, point)
+	}
+
+	return points, nil
+}
+
+// sweepPointArgs turns the parameters of a point into flags, ordered by name.
+func sweepPointArgs(params map[string]string) []string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, "--"+name, params[name])
+	}
+
+	return args
+}
+
+func formatSweepParams(params map[string]string) string {
+	args := sweepPointArgs(params)
+
+	parts := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		parts = append(parts, strings.TrimPrefix(args[i], "--")+"="+args[i+1])
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// SweepManifest is written to .sweeps/<sweep>.json of the experiment and
+// tracks every point of the sweep.
+type SweepManifest struct {
+	Project    string       `json:"project"`
+	Experiment string       `json:"experiment"`
+	Sweep      string       `json:"sweep"`
+	Spec       SweepSpec    `json:"spec"`
+	Rest       []string     `json:"rest"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+	Points     []SweepPoint `json:"points"`
+}
+
+type SweepPoint struct {
+	Index  int               `json:"index"`
+	Run    string            `json:"run"`
+	Params map[string]string `json:"params"`
+	// Args are appended to the arguments every point gets.
+	Args   []string `json:"args"`
+	Status string   `json:"status"`
+	// Host the point was launched on.
+	Host        string     `json:"host,omitempty"`
+	ContainerID string     `json:"container_id,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func loadSweepManifest(path string) (*SweepManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	var manifest SweepManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return &manifest, nil
+}
+
+func (m *SweepManifest) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.WithMessagef(err, "failed to create directory for %s", path)
+	}
+
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode sweep manifest")
+	}
+
+	return writeFileAtomic(path, append(content, '\n'), 0o644, true)
+}
+
+// newSweepManifest names the runs of the points after the sweep, e.g.
+// lr_sweep_007.
+func newSweepManifest(args SweepArgs, spec *SweepSpec, points []map[string]string) *SweepManifest {
+	width := len(strconv.Itoa(len(points) - 1))
+	if width < 3 {
+		width = 3
+	}
+
+	now := time.Now()
+	manifest := &SweepManifest{
+		Project:    args.ProjectName,
+		Experiment: args.ExperimentName,
+		Sweep:      args.SweepName,
+		Spec:       *spec,
+		Rest:       args.Rest,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	for i, params := range points {
+		manifest.Points = append(manifest.Points, SweepPoint{
+			Index:  i,
+			Run:    fmt.Sprintf("%s_%0*d", args.SweepName, width, i),
+			Params: params,
+			Args:   sweepPointArgs(params),
+			Status: sweepPointPending,
+		})
+	}
+
+	return manifest
+}
+
+// carryOver takes the state of the points over from an earlier start of the
+// same sweep, which has to have had the same points.
+func (m *SweepManifest) carryOver(previous *SweepManifest) error {
+	same := len(previous.Points) == len(m.Points) && strings.Join(previous.Rest, "\x00") == strings.Join(m.Rest, "\x00")
+	for i := 0; same && i < len(m.Points); i++ {
+		same = previous.Points[i].Run == m.Points[i].Run &&
+			strings.Join(previous.Points[i].Args, "\x00") == strings.Join(m.Points[i].Args, "\x00")
+	}
+	if !same {
+		return errors.Errorf("sweep %s already exists with different points, pick another --sweep_name", m.Sweep)
+	}
+
+	m.CreatedAt = previous.CreatedAt
+	copy(m.Points, previous.Points)
+
+	return nil
+}
+
+type SweepArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	SweepName      string `validate:"required,varname"`
+	Spec           string `validate:"required"`
+	Concurrency    int    `validate:"min=1"`
+	GPUsPerRun     int    `validate:"min=0"`
+	GPUWait        int    `validate:"min=0"`
+	NProcPerNode   int    `validate:"min=0"`
+	// Hosts the points are spread over, Concurrency of them at a time on
+	// every host. Hosts other than localhost are launched on over ssh and
+	// watched through their docker daemon, reached over ssh as well.
+	Hosts         []string `validate:"required,min=1,dive,required"`
+	SSH           SSHSpec
+	RemoteInvoker string
+	// RemoteDir is the project directory on the hosts, the local one if
+	// empty.
+	RemoteDir string
+	// RunFlags are passed on to experiment run as they are.
+	RunFlags []string
+	Rest     []string
+	CacheDir string
+}
+
+// sweepLocalHost is the host launched on without ssh.
+const sweepLocalHost = "localhost"
+
+// sweepHost is a host of the sweep with the image its points run, empty for
+// other hosts, whose invoker builds the project there.
+type sweepHost struct {
+	dr    *DockerRun
+	image string
+}
+
+type sweepRunner struct {
+	args   SweepArgs
+	layout *Layout
+	hosts  map[string]*sweepHost
+	// executable is invoker itself, every point is launched by an experiment
+	// run of its own
+	executable string
+
+	// mu guards manifest, which is saved on every change
+	mu       sync.Mutex
+	manifest *SweepManifest
+	path     string
+
+	// output keeps the lines of the points apart
+	output sync.Mutex
+}
+
+func newSweepHost(projectName, cwd string, layout *Layout, endpoint DockerEndpoint, gitState *GitInfo) (*sweepHost, error) {
+	dr, err := NewDockerRun(context.Background(), projectName, cwd, layout, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.remote() {
+		return &sweepHost{dr: dr}, nil
+	}
+
+	if err := dr.buildImage(gitState); err != nil {
+		return nil, errors.WithMessage(err, "failed to build the image")
+	}
+	image, _, err := dr.client.ImageInspectWithRaw(dr.ctx, dr.imageTag)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to inspect image %s", dr.imageTag)
+	}
+
+	return &sweepHost{dr: dr, image: image.ID}, nil
+}
+
+func (s *sweepRunner) point(i int) SweepPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.manifest.Points[i]
+}
+
+func (s *sweepRunner) update(i int, fn func(p *SweepPoint)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(&s.manifest.Points[i])
+	s.manifest.UpdatedAt = time.Now()
+	if err := s.manifest.save(s.path); err != nil {
+		fmt.Printf("failed to write sweep manifest: %v\n", err)
+	}
+}
+
+func (s *sweepRunner) fail(i int, err error) {
+	now := time.Now()
+	s.update(i, func(p *SweepPoint) {
+		p.Status = sweepPointFailed
+		p.Error = err.Error()
+		p.FinishedAt = &now
+	})
+	s.printf(i, "failed: %v\n", err)
+}
+
+func (s *sweepRunner) printf(i int, format string, a ...interface{}) {
+	s.output.Lock()
+	defer s.output.Unlock()
+
+	fmt.Printf("[%s] "+format, append([]interface{}{s.point(i).Run}, a...)...)
+}
+
+func (s *sweepRunner) containerName(runName string) string {
+	return DefaultProjExpContainerName(s.args.ProjectName, s.args.ExperimentName) + "-" + runName
+}
+
+// runArgs are the arguments of the experiment run launching a point on a
+// host, the port is derived from the run name so points do not collide.
+func (s *sweepRunner) runArgs(point SweepPoint, host string) []string {
+	nproc := s.args.NProcPerNode
+	if nproc == 0 {
+		nproc = max(s.args.GPUsPerRun, 1)
+	}
+
+	args := []string{
+		"experiment", "run",
+		"--project_name", s.args.ProjectName,
+		"--experiment_name", s.args.ExperimentName,
+		"--run_name", point.Run,
+		"--container_name", s.containerName(point.Run),
+		"--hosts", host,
+		"--port", "0",
+		"--nproc_per_node", fmt.Sprint(nproc),
+	}
+	if image := s.hosts[host].image; image != "" {
+		args = append(args, "--image", image)
+	}
+	if host != sweepLocalHost {
+		args = append(args,
+			"--ssh",
+			"--ssh_port", fmt.Sprint(s.args.SSH.Port),
+			"--ssh_timeout", fmt.Sprint(s.args.SSH.Timeout),
+			"--remote_invoker", s.args.RemoteInvoker,
+		)
+		optional := [][2]string{
+			{"--ssh_user", s.args.SSH.User},
+			{"--ssh_key", s.args.SSH.Key},
+			{"--ssh_known_hosts", s.args.SSH.KnownHosts},
+			{"--remote_dir", s.args.RemoteDir},
+		}
+		for _, flag := range optional {
+			if flag[1] != "" {
+				args = append(args, flag[0], flag[1])
+			}
+		}
+	}
+	if s.args.CacheDir != "" {
+		args = append(args, "--cache_dir", s.args.CacheDir)
+	}
+	if s.args.GPUsPerRun > 0 {
+		args = append(args,
+			"--gpus", fmt.Sprintf("auto:%d", s.args.GPUsPerRun),
+			"--gpu_wait", fmt.Sprint(s.args.GPUWait),
+		)
+	}
+	args = append(args, s.args.RunFlags...)
+	args = append(args, "--")
+	args = append(args, s.args.Rest...)
+
+	return append(args, point.Args...)
+}
+
+// pickUp waits for the container of a point that an earlier start of the
+// sweep left running on one of the hosts, false if there is none.
+func (s *sweepRunner) pickUp(i int) bool {
+	point := s.point(i)
+	h, ok := s.hosts[point.Host]
+	if point.Status != sweepPointRunning || point.ContainerID == "" || !ok {
+		return false
+	}
+
+	info, err := h.dr.client.ContainerInspect(h.dr.ctx, s.containerName(point.Run))
+	if err != nil || info.ID != point.ContainerID {
+		return false
+	}
+
+	s.printf(i, "waiting for container %s of an earlier start on %s\n", info.Name, point.Host)
+	s.wait(i, h.dr, info.ID)
+
+	return true
+}
+
+// runPoint launches a point on a host and waits for it to exit.
+func (s *sweepRunner) runPoint(i int, host string) {
+	point := s.point(i)
+	h := s.hosts[host]
+
+	now := time.Now()
+	s.update(i, func(p *SweepPoint) {
+		p.Status, p.Host = sweepPointRunning, host
+		p.ContainerID, p.ExitCode, p.Error = "", nil, ""
+		p.StartedAt, p.FinishedAt = &now, nil
+	})
+	s.printf(i, "launching on %s\n", host)
+
+	out := newPrefixWriter(&s.output, os.Stdout, "["+point.Run+"] ")
+	cmd := exec.Command(s.executable, s.runArgs(point, host)...)
+	cmd.Stdout, cmd.Stderr = out, out
+	// an interrupt of the sweep should not cut a launch short
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Run()
+	out.Flush()
+	if err != nil {
+		s.fail(i, errors.WithMessage(err, "experiment run failed"))
+		return
+	}
+
+	info, err := h.dr.Inspect(s.containerName(point.Run))
+	if err != nil {
+		s.fail(i, err)
+		return
+	}
+	s.update(i, func(p *SweepPoint) { p.ContainerID = info.ID })
+
+	s.wait(i, h.dr, info.ID)
+}
+
+func (s *sweepRunner) wait(i int, dr *DockerRun, containerID string) {
+	statusCh, errCh := dr.client.ContainerWait(dr.ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		s.fail(i, errors.WithMessage(err, "failed to wait for the container"))
+		return
+	case <-statusCh:
+	}
+
+	var state *types.ContainerState
+	info, err := dr.client.ContainerInspect(dr.ctx, containerID)
+	if err == nil {
+		state = info.State
+		// the run manifests of other hosts are in their caches, they record
+		// the end once run list or status look at them there
+		if !dr.endpoint.remote() {
+			if err := dr.finalizeRunManifest(info, false); err != nil {
+				s.printf(i, "failed to update run manifest: %v\n", err)
+			}
+		}
+	} else if dr.endpoint.remote() {
+		s.fail(i, errors.WithMessage(err, "container is gone"))
+		return
+	} else {
+		// removed in the meantime, e.g. by experiment kill, which recorded
+		// the end in the run manifest
+		point := s.point(i)
+		manifest, manifestErr := loadRunManifest(s.layout.RunManifestPath(s.args.ProjectName, s.args.ExperimentName, point.Run))
+		if manifestErr != nil || manifest.ContainerID != containerID || manifest.ExitCode == nil {
+			s.fail(i, errors.WithMessage(err, "container is gone"))
+			return
+		}
+		state = &types.ContainerState{ExitCode: *manifest.ExitCode, FinishedAt: manifest.FinishedAt.Format(time.RFC3339Nano)}
+	}
+
+	finishedAt := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil && !t.IsZero() {
+		finishedAt = t
+	}
+
+	s.update(i, func(p *SweepPoint) {
+		p.ExitCode = PtrTo(state.ExitCode)
+		p.FinishedAt = &finishedAt
+		if state.ExitCode == 0 {
+			p.Status = sweepPointCompleted
+		} else {
+			p.Status = sweepPointFailed
+		}
+	})
+	s.printf(i, "exited with code %d\n", state.ExitCode)
+}
+
+func (s *sweepRunner) printSummary() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "RUN\tSTATUS\tEXIT\tPARAMS\n")
+	for _, p := range s.manifest.Points {
+		exitCode := "-"
+		if p.ExitCode != nil {
+			exitCode = fmt.Sprint(*p.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Run, p.Status, exitCode, formatSweepParams(p.Params))
+		ok = ok && p.Status == sweepPointCompleted
+	}
+	w.Flush()
+
+	return ok
+}
+
+// Sweep launches a run for every point of the spec on the hosts, at most
+// Concurrency at a time on each, and waits for them to exit. Starting a sweep
+// again skips the points that completed and waits for the ones still
+// running.
+func Sweep(args SweepArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	spec, err := loadSweepSpec(args.Spec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	points, err := spec.points(args.SweepName)
+	if err != nil {
+		fmt.Printf("invalid sweep spec %s: %v\n", args.Spec, err)
+		os.Exit(1)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	path := layout.SweepManifestPath(args.ProjectName, args.ExperimentName, args.SweepName)
+	manifest := newSweepManifest(args, spec, points)
+	if previous, err := loadSweepManifest(path); err == nil {
+		if err := manifest.carryOver(previous); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	s := &sweepRunner{args: args, layout: layout, manifest: manifest, path: path}
+
+	var left []int
+	for i, p := range manifest.Points {
+		if p.Status != sweepPointCompleted {
+			left = append(left, i)
+		}
+	}
+	fmt.Printf("sweep %s has %d points, %d left, manifest at %s\n", args.SweepName, len(manifest.Points), len(left), path)
+
+	if len(left) > 0 {
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("failed to get current working directory: %v\n", err)
+			os.Exit(1)
+		}
+
+		gitState, err := gitInfo(cwd)
+		if err != nil {
+			fmt.Printf("warning: failed to get git state of %s: %v\n", cwd, err)
+		}
+
+		if s.executable, err = os.Executable(); err != nil {
+			fmt.Printf("failed to find the invoker executable: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := manifest.save(path); err != nil {
+			fmt.Printf("failed to write sweep manifest: %v\n", err)
+			os.Exit(1)
+		}
+
+		// built once here, every local point runs the same image
+		if err := writeRunScript(); err != nil {
+			fmt.Printf("failed to create a file: %v\n", err)
+		}
+		s.hosts = make(map[string]*sweepHost, len(args.Hosts))
+		for _, host := range args.Hosts {
+			endpoint := DockerEndpoint{}
+			if host != sweepLocalHost {
+				endpoint = DockerEndpoint{Host: "ssh://" + host, SSH: args.SSH}
+			}
+
+			h, err := newSweepHost(args.ProjectName, cwd, layout, endpoint, gitState)
+			if err != nil {
+				fmt.Printf("failed to prepare %s: %v\n", host, err)
+				os.Exit(1)
+			}
+			s.hosts[host] = h
+		}
+
+		interrupted := make(chan struct{})
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			fmt.Println("interrupted, no more points are launched, interrupt again to stop waiting for the running ones")
+			close(interrupted)
+			<-signals
+			fmt.Println("leaving the running points behind, start the sweep again to pick them up")
+			os.Exit(1)
+		}()
+
+		// a slot is a host that can take another point, every host has
+		// Concurrency of them
+		pool := make([]string, 0, args.Concurrency*len(args.Hosts))
+		for n := 0; n < args.Concurrency; n++ {
+			pool = append(pool, args.Hosts...)
+		}
+
+		var wg sync.WaitGroup
+		slots := make(chan string, cap(pool))
+		start := func(i int, host string) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { slots <- host }()
+				if !s.pickUp(i) {
+					s.runPoint(i, host)
+				}
+			}()
+		}
+
+		// points an earlier start left running keep a slot of their host
+		queued := make([]int, 0, len(left))
+		for _, i := range left {
+			p := manifest.Points[i]
+			if n := slices.Index(pool, p.Host); p.Status == sweepPointRunning && n != -1 {
+				pool = slices.Delete(pool, n, n+1)
+				start(i, p.Host)
+				continue
+			}
+			queued = append(queued, i)
+		}
+		for _, host := range pool {
+			slots <- host
+		}
+
+	schedule:
+		for _, i := range queued {
+			var host string
+			select {
+			case host = <-slots:
+			case <-interrupted:
+				break schedule
+			}
+
+			select {
+			case <-interrupted:
+				slots <- host
+				break schedule
+			default:
+			}
+
+			start(i, host)
+		}
+		wg.Wait()
+	}
+
+	if !s.printSummary() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// runTags reads the tags of a run, one per line. Tagged runs are kept by
+// run prune.
+func runTags(layout *Layout, projectName, experimentName, runName string) ([]string, error) {
+	path := layout.RunTagsPath(projectName, experimentName, runName)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	var tags []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if tag := strings.TrimSpace(line); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+type TagArgs struct {
+	ProjectName    string   `validate:"required,varname"`
+	ExperimentName string   `validate:"required,varname"`
+	RunName        string   `validate:"required,varname"`
+	Tags           []string `validate:"required,min=1,dive,varname"`
+	Remove         bool
+	CacheDir       string
+}
+
+func TagRun(args TagArgs) {
+	if err := Validator().Struct(args); err != nil {
+		panic(err)
+	}
+
+	layout, err := NewLayout(args.CacheDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	runDir := layout.RunDir(args.ProjectName, args.ExperimentName, args.RunName)
+	if _, err := os.Stat(runDir); err != nil {
+		fmt.Printf("run %s of experiment %s not found in %s\n", args.RunName, args.ExperimentName, layout.ExperimentDir(args.ProjectName, args.ExperimentName))
+		os.Exit(1)
+	}
+
+	tags, err := runTags(layout, args.ProjectName, args.ExperimentName, args.RunName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, tag := range args.Tags {
+		i := slices.Index(tags, tag)
+		if args.Remove && i != -1 {
+			tags = slices.Delete(tags, i, i+1)
+		} else if !args.Remove && i == -1 {
+			tags = append(tags, tag)
+		}
+	}
+
+	metadataDir := Path{path: layout.RunMetadataDir(args.ProjectName, args.ExperimentName, args.RunName)}
+	if err := metadataDir.mkdirIfNotExists(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	content := strings.Join(tags, "\n")
+	if content != "" {
+		content += "\n"
+	}
+
+	if err := writeFileAtomic(layout.RunTagsPath(args.ProjectName, args.ExperimentName, args.RunName), []byte(content), 0o644, true); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("tags of %s: %s\n", args.RunName, valueOr(strings.Join(tags, ", "), "-"))
+}
@@ -3,42 +3,276 @@ package main
 import (
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/docker/docker/pkg/namesgenerator"
 	"github.com/ml-doom/invoker/internal"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{Use: "higgsfield"}
 
 var experimentCmd = &cobra.Command{Use: "experiment", Short: "Experiment commands"}
 
+var runsCmd = &cobra.Command{Use: "run", Short: "Commands for the runs kept in the cache"}
+
+var queueCmd = &cobra.Command{Use: "queue", Short: "Commands for the run queue of this host"}
+
 func runCmdFunc() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "run",
 		Short: "Run an experiment",
 		Run: func(cmd *cobra.Command, args []string) {
-			internal.Run(internal.RunArgs{
-				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+			runArgs := internal.RunArgs{
+				ExperimentName:   internal.ParseOrExit[string](cmd, "experiment_name"),
+				ProjectName:      internal.ParseOrExit[string](cmd, "project_name"),
+				Port:             internal.ParseOrExit[int](cmd, "port"),
+				RunName:          internal.ParseOrExit[string](cmd, "run_name"),
+				NProcPerNode:     internal.ParseOrExit[int](cmd, "nproc_per_node"),
+				Hosts:            internal.ParseOrExit[[]string](cmd, "hosts"),
+				MaxRepeats:       -1,
+				ContainerName:    internal.ParseOrNil[string](cmd, "container_name"),
+				Rest:             args,
+				PortRange:        internal.ParseOrExit[string](cmd, "port_range"),
+				PreflightTimeout: internal.ParseOrExit[int](cmd, "preflight_timeout"),
+				GPUs:             internal.ParseOrExit[string](cmd, "gpus"),
+				GPUWait:          internal.ParseOrExit[int](cmd, "gpu_wait"),
+				Accelerator:      internal.ParseOrExit[string](cmd, "accelerator"),
+				HostProfile:      internal.ParseOrExit[string](cmd, "host_profile"),
+				Mounts:           internal.ParseOrExit[internal.StringArray](cmd, "mount"),
+				ShmSize:          internal.ParseOrExit[string](cmd, "shm_size"),
+				CPUSet:           internal.ParseOrExit[string](cmd, "cpuset"),
+				CPUPinning:       internal.ParseOrExit[string](cmd, "cpu_pinning"),
+				Memory:           internal.ParseOrExit[string](cmd, "memory"),
+				Ulimits:          internal.ParseOrExit[internal.StringArray](cmd, "ulimit"),
+				IPC:              internal.ParseOrExit[string](cmd, "ipc"),
+				SecurityMode:     internal.ParseOrExit[string](cmd, "security_mode"),
+				SeccompProfile:   internal.ParseOrExit[string](cmd, "seccomp_profile"),
+				AppArmorProfile:  internal.ParseOrExit[string](cmd, "apparmor_profile"),
+				Privileged:       internal.ParseOrExit[bool](cmd, "privileged"),
+				CacheDir:         internal.ParseOrExit[string](cmd, "cache_dir"),
+				RequireClean:     internal.ParseOrExit[bool](cmd, "require_clean"),
+				IsolateCaches:    internal.ParseOrExit[bool](cmd, "isolate_caches"),
+				RunNameStyle:     internal.ParseOrExit[string](cmd, "run_name_style"),
+				RunNonce:         internal.ParseOrExit[string](cmd, "run_nonce"),
+				Image:            internal.ParseOrExit[string](cmd, "image"),
+				Rank:             optionalInt(cmd, "rank"),
+			}
+
+			if endpoints := dockerEndpoints(cmd); endpoints.Template != "" {
+				if internal.ParseOrExit[bool](cmd, "ssh") {
+					fmt.Println("--ssh and --docker_endpoint are two ways to reach the hosts, pick one")
+					os.Exit(1)
+				}
+
+				internal.RunOnEndpoints(internal.EndpointRunArgs{
+					Run:       runArgs,
+					Endpoints: endpoints,
+					RemoteDir: internal.ParseOrExit[string](cmd, "remote_dir"),
+					Wait:      internal.ParseOrExit[bool](cmd, "wait"),
+				})
+				return
+			}
+
+			if internal.ParseOrExit[bool](cmd, "ssh") {
+				internal.RunOverSSH(internal.FanOutArgs{
+					Run:           runArgs,
+					Flags:         forwardedFlags(cmd, "ssh", "run_name", "port", "run_name_style", "run_nonce", "rank", "remote_invoker", "remote_dir", "ssh_user", "ssh_port", "ssh_key", "ssh_known_hosts", "ssh_timeout"),
+					SSH:           sshSpec(cmd),
+					RemoteInvoker: internal.ParseOrExit[string](cmd, "remote_invoker"),
+					RemoteDir:     internal.ParseOrExit[string](cmd, "remote_dir"),
+				})
+				return
+			}
+
+			if internal.ParseOrExit[bool](cmd, "queue") {
+				internal.Enqueue(internal.EnqueueArgs{
+					Run:      runArgs,
+					Priority: internal.ParseOrExit[int](cmd, "priority"),
+				})
+				return
+			}
+
+			internal.Run(runArgs)
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().Int("port", 1234, "port to run the experiment on, 0 derives it from the experiment and run names")
+	cmd.PersistentFlags().String("port_range", internal.DefaultPortRange, "range to derive the port from when --port=0")
+	cmd.PersistentFlags().String("gpus", "", "comma separated gpu indices to give to the experiment, e.g. 0,1,2,3, or auto:N to pick N free ones, defaults to all; unlike docker --gpus a single number is an index, --gpus=4 is gpu 4 and not 4 gpus")
+	cmd.PersistentFlags().String("accelerator", "auto", "accelerator to expose to the experiment: auto, nvidia, rocm, habana or none")
+	cmd.PersistentFlags().String("host_profile", "auto", "host profile: auto, cos-tcpx, cloud-vm, bare-metal or a custom one from /etc/invoker/profiles or ~/.config/invoker/profiles")
+	cmd.PersistentFlags().StringArray("mount", []string{}, "extra mount in docker --mount syntax, e.g. type=bind,source=/data,target=/data,readonly or type=tmpfs,target=/scratch,tmpfs-size=8g, repeatable")
+	cmd.PersistentFlags().String("ipc", "", "ipc namespace: host, private or shareable, defaults to host")
+	cmd.PersistentFlags().String("shm_size", "", "size of /dev/shm when not using the host ipc namespace, e.g. 32g")
+	cmd.PersistentFlags().String("cpuset", "", "cpus the experiment may use, e.g. 0-15,32-47")
+	cmd.PersistentFlags().String("cpu_pinning", "", "set to numa to pin every local rank to the cpus local to its gpu")
+	cmd.PersistentFlags().String("memory", "", "memory limit, e.g. 256g")
+	cmd.PersistentFlags().StringArray("ulimit", []string{}, "ulimit as name=soft[:hard], overrides the memlock and stack defaults, repeatable")
+	cmd.PersistentFlags().String("security_mode", "", "privileged or hardened, defaults to the project config or privileged")
+	cmd.PersistentFlags().String("seccomp_profile", "", "seccomp profile to apply in hardened mode")
+	cmd.PersistentFlags().String("apparmor_profile", "", "apparmor profile to apply in hardened mode")
+	cmd.PersistentFlags().Bool("privileged", false, "run privileged even if the project config asks for hardened mode")
+	cmd.PersistentFlags().Bool("require_clean", false, "refuse to launch if the project has uncommitted changes")
+	cmd.PersistentFlags().Bool("isolate_caches", false, "do not bind huggingface and torch of the cache root into the container")
+	cmd.PersistentFlags().Int("gpu_wait", 0, "seconds to wait for enough free gpus with --gpus=auto:N, 0 refuses to launch right away")
+	cmd.PersistentFlags().Int("preflight_timeout", 120, "seconds to wait for all hosts to reach the master port before launching, 0 skips the check")
+	cmd.PersistentFlags().String("run_name", "", "name of the run, generated if not given")
+	cmd.PersistentFlags().String("run_name_style", "name", "style of generated run names: name or timestamp")
+	cmd.PersistentFlags().String("run_nonce", "", "shared value all hosts derive a generated run name from, e.g. $(date +%s), defaults to $INVOKER_RUN_NONCE")
+	cmd.PersistentFlags().Int("nproc_per_node", 1, "number of processes per node")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("image", "", "image to run instead of building the project, e.g. an image id")
+	cmd.PersistentFlags().Bool("queue", false, "add the run to the queue of this host instead of launching it, see queue worker")
+	cmd.PersistentFlags().Int("priority", 0, "priority of a queued run, higher ones start first")
+	cmd.PersistentFlags().Int("rank", -1, "rank of this host, found from its addresses if not given")
+	cmd.PersistentFlags().Bool("ssh", false, "launch the run on every host of --hosts over ssh from this machine")
+	cmd.PersistentFlags().String("remote_invoker", "invoker", "invoker executable on the hosts, with --ssh")
+	cmd.PersistentFlags().String("remote_dir", "", "project directory on the hosts, with --ssh or --docker_endpoint, defaults to the current directory")
+	cmd.PersistentFlags().Bool("wait", false, "with --docker_endpoint, follow the output of every rank until it exits and fail if any rank failed")
+	addSSHFlags(cmd)
+	addDockerEndpointFlags(cmd)
+
+	return cmd
+}
+
+func sweepCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sweep",
+		Short: "Launch a run for every point of a hyperparameter sweep",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Sweep(internal.SweepArgs{
 				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
-				Port:           internal.ParseOrExit[int](cmd, "port"),
-				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				SweepName:      internal.ParseOrExit[string](cmd, "sweep_name"),
+				Spec:           internal.ParseOrExit[string](cmd, "spec"),
+				Concurrency:    internal.ParseOrExit[int](cmd, "concurrency"),
+				GPUsPerRun:     internal.ParseOrExit[int](cmd, "gpus_per_run"),
+				GPUWait:        internal.ParseOrExit[int](cmd, "gpu_wait"),
 				NProcPerNode:   internal.ParseOrExit[int](cmd, "nproc_per_node"),
 				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
-				MaxRepeats:     -1,
-				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				SSH:            sshSpec(cmd),
+				RemoteInvoker:  internal.ParseOrExit[string](cmd, "remote_invoker"),
+				RemoteDir:      internal.ParseOrExit[string](cmd, "remote_dir"),
+				RunFlags:       internal.ParseOrExit[internal.StringArray](cmd, "run_flag"),
 				Rest:           args,
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
 			})
 		},
 	}
 
 	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
 	cmd.PersistentFlags().String("project_name", "", "name of the project")
-	cmd.PersistentFlags().Int("port", 1234, "port to run the experiment on")
-	cmd.PersistentFlags().String("run_name", "", "name of the run")
-	cmd.PersistentFlags().Int("nproc_per_node", 1, "number of processes per node")
-	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
-  cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("sweep_name", "", "name of the sweep, the runs are named after it")
+	cmd.PersistentFlags().String("spec", "", "json file with the grid, random or list spec of the sweep")
+	cmd.PersistentFlags().Int("concurrency", 1, "number of points running at the same time on every host")
+	cmd.PersistentFlags().Int("gpus_per_run", 0, "free gpus to give every point, 0 gives all of them to every point")
+	cmd.PersistentFlags().Int("gpu_wait", 86400, "seconds a point waits for free gpus")
+	cmd.PersistentFlags().Int("nproc_per_node", 0, "number of processes per point, defaults to --gpus_per_run")
+	cmd.PersistentFlags().StringArray("run_flag", []string{}, "flag passed on to experiment run, e.g. --run_flag=--memory=64g, repeatable")
+	cmd.PersistentFlags().StringSlice("hosts", []string{"localhost"}, "hosts to spread the points over, other hosts than localhost are reached over ssh")
+	cmd.PersistentFlags().String("remote_invoker", "invoker", "invoker executable on the hosts")
+	cmd.PersistentFlags().String("remote_dir", "", "project directory on the hosts, defaults to the current directory")
+	addSSHFlags(cmd)
+
+	return cmd
+}
+
+// optionalInt is nil for a flag that was not given.
+func optionalInt(cmd *cobra.Command, flag string) *int {
+	if !cmd.Flags().Changed(flag) {
+		return nil
+	}
+
+	return internal.PtrTo(internal.ParseOrExit[int](cmd, flag))
+}
+
+// forwardedFlags turns the flags given to cmd, except skipped ones, back into
+// arguments, e.g. to run the same command on another host.
+func forwardedFlags(cmd *cobra.Command, skip ...string) []string {
+	var args []string
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if slices.Contains(skip, f.Name) {
+			return
+		}
+
+		if values, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range values.GetSlice() {
+				args = append(args, "--"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+
+	return args
+}
+
+func addSSHFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("ssh_user", "", "user to log in as on the hosts, defaults to the local user")
+	cmd.PersistentFlags().Int("ssh_port", 22, "ssh port of the hosts")
+	cmd.PersistentFlags().String("ssh_key", "", "private key to log in with, next to the keys of ssh-agent")
+	cmd.PersistentFlags().String("ssh_known_hosts", "", "known hosts file, defaults to ~/.ssh/known_hosts")
+	cmd.PersistentFlags().Int("ssh_timeout", 30, "seconds to wait for a connection")
+}
+
+func sshSpec(cmd *cobra.Command) internal.SSHSpec {
+	return internal.SSHSpec{
+		User:       internal.ParseOrExit[string](cmd, "ssh_user"),
+		Port:       internal.ParseOrExit[int](cmd, "ssh_port"),
+		Key:        internal.ParseOrExit[string](cmd, "ssh_key"),
+		KnownHosts: internal.ParseOrExit[string](cmd, "ssh_known_hosts"),
+		Timeout:    internal.ParseOrExit[int](cmd, "ssh_timeout"),
+	}
+}
+
+func addDockerEndpointFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("docker_endpoint", "", "docker daemon of every host of --hosts, {host} stands for the host, e.g. ssh://{host} or tcp://{host}:2376, drives all hosts from this machine")
+	cmd.PersistentFlags().String("docker_tls_dir", "", "directory with ca.pem, cert.pem and key.pem for tcp endpoints, defaults to $DOCKER_CERT_PATH")
+}
+
+func dockerEndpoints(cmd *cobra.Command) internal.DockerEndpoints {
+	return internal.DockerEndpoints{
+		Template: internal.ParseOrExit[string](cmd, "docker_endpoint"),
+		TLSDir:   internal.ParseOrExit[string](cmd, "docker_tls_dir"),
+		SSH:      sshSpec(cmd),
+	}
+}
+
+func resumeCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Launch a run again from its latest checkpoint",
+		Long: `Launch a run again from its latest checkpoint.
+
+The arguments and the image are taken from the run.json of the previous launch,
+the latest checkpoint is passed to the training code as $INVOKER_RESUME_CHECKPOINT,
+and with --checkpoint_arg as an argument as well. The latest checkpoint is the
+entry of the run directory matching --checkpoint_pattern with the highest number
+in its name. Run it from the project directory on every host, like experiment run.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Resume(internal.ResumeArgs{
+				ProjectName:        internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName:     internal.ParseOrExit[string](cmd, "experiment_name"),
+				RunName:            internal.ParseOrExit[string](cmd, "run_name"),
+				Checkpoint:         internal.ParseOrExit[string](cmd, "checkpoint"),
+				CheckpointPatterns: internal.ParseOrExit[[]string](cmd, "checkpoint_pattern"),
+				CheckpointArg:      internal.ParseOrExit[string](cmd, "checkpoint_arg"),
+				CacheDir:           internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("run_name", "", "name of the run to resume")
+	cmd.PersistentFlags().String("checkpoint", "", "checkpoint to resume from, relative to the run directory, instead of the latest one")
+	cmd.PersistentFlags().StringSlice("checkpoint_pattern", nil, "glob patterns of the checkpoints in the run directory, defaults to checkpoint*,ckpt*,step*,global_step*,epoch*,*.ckpt")
+	cmd.PersistentFlags().String("checkpoint_arg", "", "training argument to pass the checkpoint in as well, e.g. --resume_from")
 
 	return cmd
 }
@@ -48,36 +282,348 @@ func killCmdFunc() *cobra.Command {
 		Use:   "kill",
 		Short: "Kill an experiment",
 		Run: func(cmd *cobra.Command, args []string) {
-			internal.Kill(internal.KillArgs{
+			killArgs := internal.KillArgs{
 				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
 				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
 				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
 				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
-			})
+				Rank:           optionalInt(cmd, "rank"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			}
+
+			if endpoints := dockerEndpoints(cmd); endpoints.Template != "" {
+				internal.KillOnEndpoints(internal.EndpointKillArgs{
+					Kill:      killArgs,
+					Endpoints: endpoints,
+					Timeout:   internal.ParseOrExit[int](cmd, "timeout"),
+				})
+				return
+			}
+
+			if internal.ParseOrExit[bool](cmd, "all_hosts") {
+				internal.KillAllHosts(internal.KillAllHostsArgs{
+					Kill:          killArgs,
+					Flags:         forwardedFlags(cmd, "all_hosts", "rank", "timeout", "remote_invoker", "ssh_user", "ssh_port", "ssh_key", "ssh_known_hosts", "ssh_timeout"),
+					SSH:           sshSpec(cmd),
+					RemoteInvoker: internal.ParseOrExit[string](cmd, "remote_invoker"),
+					Timeout:       internal.ParseOrExit[int](cmd, "timeout"),
+				})
+				return
+			}
+
+			internal.Kill(killArgs)
 		},
 	}
 
 	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
 	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
 	cmd.PersistentFlags().String("project_name", "", "name of the project")
-  cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().Int("rank", -1, "rank of this host, found from its addresses if not given")
+	cmd.PersistentFlags().Bool("all_hosts", false, "kill the experiment on every host of --hosts over ssh from this machine")
+	cmd.PersistentFlags().Int("timeout", 60, "seconds every host gets with --all_hosts or --docker_endpoint, 0 waits as long as it takes")
+	cmd.PersistentFlags().String("remote_invoker", "invoker", "invoker executable on the hosts, with --all_hosts")
+	addSSHFlags(cmd)
+	addDockerEndpointFlags(cmd)
+
+	return cmd
+}
+
+func statusCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the state and effective security settings of an experiment",
+		Run: func(cmd *cobra.Command, args []string) {
+			statusArgs := internal.StatusArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			}
+
+			if endpoints := dockerEndpoints(cmd); endpoints.Template != "" {
+				internal.StatusOnEndpoints(internal.EndpointStatusArgs{
+					Status:    statusArgs,
+					Hosts:     internal.ParseOrExit[[]string](cmd, "hosts"),
+					Endpoints: endpoints,
+				})
+				return
+			}
+
+			internal.Status(statusArgs)
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to show the experiment on, with --docker_endpoint")
+	addSSHFlags(cmd)
+	addDockerEndpointFlags(cmd)
+
+	return cmd
+}
+
+func listArgs(cmd *cobra.Command) internal.ListArgs {
+	return internal.ListArgs{
+		ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+		ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+		Status:         internal.ParseOrExit[string](cmd, "status"),
+		JSON:           internal.ParseOrExit[bool](cmd, "json"),
+		CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+	}
+}
+
+func addListFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("project_name", "", "only list this project")
+	cmd.PersistentFlags().String("experiment_name", "", "only list this experiment")
+	cmd.PersistentFlags().String("status", "", "only list runs with this status: running, completed, failed, killed, exited or unknown")
+	cmd.PersistentFlags().Bool("json", false, "print json instead of a table")
+}
+
+func experimentListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the experiments found in the cache",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ListExperiments(listArgs(cmd))
+		},
+	}
+
+	addListFlags(cmd)
+
+	return cmd
+}
+
+func runListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the runs found in the cache",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ListRuns(listArgs(cmd))
+		},
+	}
+
+	addListFlags(cmd)
+
+	return cmd
+}
+
+func runPruneCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete old runs from the cache",
+		Long: `Delete old runs from the cache.
+
+--keep_last and --older_than each keep runs, a run kept by neither is deleted.
+--max_total_size then deletes the oldest remaining runs until the rest fits.
+Runs with a running container are never deleted, tagged ones only with
+--keep_tagged=false.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Prune(internal.PruneArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				KeepLast:       internal.ParseOrExit[int](cmd, "keep_last"),
+				OlderThan:      internal.ParseOrExit[string](cmd, "older_than"),
+				MaxTotalSize:   internal.ParseOrExit[string](cmd, "max_total_size"),
+				KeepTagged:     internal.ParseOrExit[bool](cmd, "keep_tagged"),
+				DryRun:         internal.ParseOrExit[bool](cmd, "dry_run"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "only prune this project")
+	cmd.PersistentFlags().String("experiment_name", "", "only prune this experiment")
+	cmd.PersistentFlags().Int("keep_last", 0, "keep the last N runs of every experiment")
+	cmd.PersistentFlags().String("older_than", "", "keep runs modified more recently than this, e.g. 30d or 36h")
+	cmd.PersistentFlags().String("max_total_size", "", "delete the oldest runs until the rest takes at most this much space, e.g. 500g")
+	cmd.PersistentFlags().Bool("keep_tagged", true, "never delete tagged runs")
+	cmd.PersistentFlags().Bool("dry_run", false, "only list what would be deleted")
+
+	return cmd
+}
+
+func runTagCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tag <tag>...",
+		Short: "Tag a run, tagged runs are kept by run prune",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.TagRun(internal.TagArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
+				Tags:           args,
+				Remove:         internal.ParseOrExit[bool](cmd, "remove"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("run_name", "", "name of the run")
+	cmd.PersistentFlags().Bool("remove", false, "remove the tags instead of adding them")
+
+	return cmd
+}
+
+func syncCmdFunc(use, short string, sync func(internal.SyncArgs)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			sync(internal.SyncArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
+				Target:         internal.ParseOrExit[string](cmd, "target"),
+				Endpoint:       internal.ParseOrExit[string](cmd, "endpoint"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("run_name", "", "name of the run")
+	cmd.PersistentFlags().String("target", "", "s3://bucket/prefix, file:///path or a directory, defaults to artifacts.target in invoker.json")
+	cmd.PersistentFlags().String("endpoint", "", "url of an S3 compatible service such as MinIO, defaults to artifacts.endpoint in invoker.json or AWS")
+
+	return cmd
+}
+
+func queueWorkerCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "worker",
+		Short: "Start queued runs as their resources become free",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.QueueWorker(internal.QueueWorkerArgs{
+				Poll:     internal.ParseOrExit[int](cmd, "poll"),
+				Once:     internal.ParseOrExit[bool](cmd, "once"),
+				CacheDir: internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Int("poll", 10, "seconds between looks at the queue")
+	cmd.PersistentFlags().Bool("once", false, "start what can be started and exit")
+
+	return cmd
+}
+
+func queueListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List the queued runs",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.QueueList(internal.QueueListArgs{
+				All:      internal.ParseOrExit[bool](cmd, "all"),
+				JSON:     internal.ParseOrExit[bool](cmd, "json"),
+				CacheDir: internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Bool("all", false, "also list started, failed and cancelled runs of the last week")
+	cmd.PersistentFlags().Bool("json", false, "print json instead of a table")
+
+	return cmd
+}
+
+func queueCancelCmdFunc() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <job id>...",
+		Short: "Take queued runs off the queue",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.QueueCancel(internal.QueueCancelArgs{
+				IDs:      args,
+				CacheDir: internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+}
+
+// queueExecCmdFunc is what the worker runs a job with.
+func queueExecCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "exec",
+		Short:  "Launch a job picked by the queue worker",
+		Hidden: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.QueueExec(internal.QueueExecArgs{
+				ID:       internal.ParseOrExit[int](cmd, "id"),
+				CacheDir: internal.ParseOrExit[string](cmd, "cache_dir"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Int("id", 0, "id of the job")
 
 	return cmd
 }
 
 func decodeSecrets() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "decode-secrets",
+		Use:   "decode-secrets [secrets]",
 		Short: "Decode secrets",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			internal.DecodeSecrets(args[0])
+			secrets := ""
+			if len(args) > 0 {
+				secrets = args[0]
+			}
+
+			internal.DecodeSecrets(internal.DecodeSecretsArgs{
+				Secrets: secrets,
+				Input:   internal.ParseOrExit[string](cmd, "input"),
+				KeyFile: internal.ParseOrExit[string](cmd, "key_file"),
+				Output:  internal.ParseOrExit[string](cmd, "output"),
+				Force:   internal.ParseOrExit[bool](cmd, "force"),
+			})
 		},
 	}
+
+	cmd.PersistentFlags().String("input", "", "file to read the secrets from, - for stdin")
+	cmd.PersistentFlags().String("key_file", "", "file with the base64 encoded key, defaults to $INVOKER_SECRETS_KEY")
+	cmd.PersistentFlags().String("output", "env", "path to write the decoded env file to")
+	cmd.PersistentFlags().Bool("force", false, "overwrite the output file if it exists")
+
 	return cmd
 
 }
 
+func encodeSecrets() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "encode-secrets",
+		Short: "Encrypt an env file for decode-secrets",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.EncodeSecrets(internal.EncodeSecretsArgs{
+				Input:   internal.ParseOrExit[string](cmd, "input"),
+				KeyFile: internal.ParseOrExit[string](cmd, "key_file"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("input", "-", "file to read the env from, - for stdin")
+	cmd.PersistentFlags().String("key_file", "", "file with the base64 encoded key, defaults to $INVOKER_SECRETS_KEY")
+
+	return cmd
+}
+
+func generateSecretsKey() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate-secrets-key",
+		Short: "Generate a key for encode-secrets and decode-secrets",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(internal.GenerateSecretsKey())
+		},
+	}
+
+	return cmd
+}
+
 func randomName() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "random-name",
@@ -94,22 +640,67 @@ func randomPort() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "random-port",
 		Short: "Generate a random port",
+		Long: `Generate a random port.
+
+When any of --project_name, --experiment_name or --run_name is given the port is
+derived from them instead, so every node of a multi-node run computes the same one.
+The derived port does not depend on the node: if another invoker run on this host
+leased it the command fails instead of returning a different one. Random ports are
+never leased or bound ones.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Print(internal.GeneratePort())
+			fmt.Print(internal.GeneratePort(internal.GeneratePortArgs{
+				Range:          internal.ParseOrExit[string](cmd, "range"),
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
+				Reserve:        internal.ParseOrExit[bool](cmd, "reserve"),
+				Owner:          internal.ParseOrExit[string](cmd, "owner"),
+				TTL:            internal.ParseOrExit[int](cmd, "ttl"),
+				CacheDir:       internal.ParseOrExit[string](cmd, "cache_dir"),
+			}))
 		},
 	}
 
+	cmd.PersistentFlags().String("range", internal.DefaultPortRange, "range to pick the port from, min-max")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("run_name", "", "name of the run")
+	cmd.PersistentFlags().Bool("reserve", false, "lease the port so other invoker runs on this host do not pick it")
+	cmd.PersistentFlags().String("owner", "", "container name the lease belongs to, it is taken over when that container starts")
+	cmd.PersistentFlags().Int("ttl", 600, "seconds to keep the lease if no container takes it over")
+
 	return cmd
 }
 
 func main() {
+	rootCmd.PersistentFlags().String("cache_dir", "", "root of the invoker cache, defaults to $XDG_CACHE_HOME or ~/.cache")
+
 	experimentCmd.AddCommand(runCmdFunc())
+	experimentCmd.AddCommand(sweepCmdFunc())
+	experimentCmd.AddCommand(resumeCmdFunc())
 	experimentCmd.AddCommand(killCmdFunc())
+	experimentCmd.AddCommand(statusCmdFunc())
+	experimentCmd.AddCommand(experimentListCmdFunc())
+
+	runsCmd.AddCommand(runListCmdFunc())
+	runsCmd.AddCommand(runPruneCmdFunc())
+	runsCmd.AddCommand(runTagCmdFunc())
+	runsCmd.AddCommand(syncCmdFunc("push", "Upload a run to the artifact store", internal.Push))
+	runsCmd.AddCommand(syncCmdFunc("pull", "Download a run from the artifact store", internal.Pull))
+
+	queueCmd.AddCommand(queueWorkerCmdFunc())
+	queueCmd.AddCommand(queueListCmdFunc())
+	queueCmd.AddCommand(queueCancelCmdFunc())
+	queueCmd.AddCommand(queueExecCmdFunc())
 
 	rootCmd.AddCommand(decodeSecrets())
+	rootCmd.AddCommand(encodeSecrets())
+	rootCmd.AddCommand(generateSecretsKey())
 	rootCmd.AddCommand(randomName())
 	rootCmd.AddCommand(randomPort())
 	rootCmd.AddCommand(experimentCmd)
+	rootCmd.AddCommand(runsCmd)
+	rootCmd.AddCommand(queueCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
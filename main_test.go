@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestForwardedFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "run", Run: func(*cobra.Command, []string) {}}
+	cmd.PersistentFlags().String("project_name", "", "")
+	cmd.PersistentFlags().Int("port", 1234, "")
+	cmd.PersistentFlags().StringSlice("hosts", nil, "")
+	cmd.PersistentFlags().StringArray("mount", nil, "")
+	cmd.PersistentFlags().Bool("ssh", false, "")
+	cmd.PersistentFlags().String("run_name", "", "")
+	cmd.PersistentFlags().String("memory", "", "")
+
+	if err := cmd.ParseFlags([]string{
+		"--project_name=proj",
+		"--port=0",
+		"--hosts=a,b",
+		"--mount", "type=bind,source=/data,target=/data",
+		"--mount", "type=tmpfs,target=/scratch",
+		"--ssh",
+		"--run_name=first",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := forwardedFlags(cmd, "ssh", "run_name", "port")
+	want := []string{
+		"--hosts=a",
+		"--hosts=b",
+		"--mount=type=bind,source=/data,target=/data",
+		"--mount=type=tmpfs,target=/scratch",
+		"--project_name=proj",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forwardedFlags = %v, want %v", got, want)
+	}
+}